@@ -1,43 +1,168 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/kairos-io/kairos-init/pkg/bundled"
 	"gopkg.in/yaml.v3"
 
+	"github.com/hashicorp/go-multierror"
 	semver "github.com/hashicorp/go-version"
 	"github.com/kairos-io/kairos-init/pkg/config"
 	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/system"
 	"github.com/kairos-io/kairos-init/pkg/validation"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types/logger"
 	"github.com/mudler/yip/pkg/schema"
+	"github.com/rs/zerolog"
 	"github.com/sanity-io/litter"
 	"github.com/spf13/cobra"
 )
 
 var (
+	configFile    string
+	rootDir       string
 	trusted       string
 	version       string
+	fips          bool
+	extensions    bool
+	lenient       bool
+	extensionDirs []string
+	overlays      []string
+	excludePkgs   []string
+	addPkgs       []string
+	optionalPkgs  []string
+	skipPkgCheck  bool
+	pkgsDistro    string
+	pkgsVersion   string
+	pkgsArch      string
+	reportPath    string
+	sbomPath      string
+	sbomFormat    string
+	sbomHostPath  string
+	mirrors       []string
+	localRepo     string
+	restoreRepos  bool
+	dlTimeout     time.Duration
+	dlRetries     int
+	caBundle      string
+	dlCache       string
 	stageFlag     = newEnumFlag([]string{"init", "install", "all"}, "all")
 	loglevelFlag  = newEnumFlag([]string{"debug", "info", "warn", "error", "trace"}, "info")
 	modelFlag     = newEnumFlag(values.SupportedModelStrings(), values.Generic.String())
-	skipStepsFlag = newEnumSliceFlag(values.GetStepNames(), []string{})
+	skipStepsFlag = newEnumSliceFlag(append(stages.GetStepNames(), stages.DeprecatedStepNames()...), []string{})
+	outputFlag    = newEnumFlag([]string{"yaml", "json"}, "yaml")
 	providers     []string
 )
 
 // Fill the flags and set default configs for commands
-func preRun(cmd *cobra.Command, _ []string) {
-	// Set the trusted boot flag to true
-	if strings.ToLower(trusted) == "true" || strings.ToLower(trusted) == "1" {
-		config.DefaultConfig.TrustedBoot = true
+// Precedence, from lowest to highest: defaults, /etc/kairos/.init_versions.yaml, the --config file,
+// environment variables and finally the flags that were explicitly set in the command line
+func preRun(cmd *cobra.Command, _ []string) error {
+	if configFile != "" {
+		if err := config.DefaultConfig.LoadFile(configFile); err != nil {
+			return err
+		}
+		// Environment variables take precedence over the config file
+		config.DefaultConfig.LoadEnv()
+	}
+
+	flags := cmd.Flags()
+	if flags.Changed("root") {
+		config.DefaultConfig.Root = rootDir
+	}
+	if config.HasRoot() {
+		root, err := filepath.Abs(config.DefaultConfig.Root)
+		if err != nil {
+			return fmt.Errorf("invalid root %s: %w", config.DefaultConfig.Root, err)
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return fmt.Errorf("root %s is not a directory", root)
+		}
+		config.DefaultConfig.Root = root
+	}
+	if flags.Changed("trusted") {
+		config.DefaultConfig.TrustedBoot = strings.ToLower(trusted) == "true" || strings.ToLower(trusted) == "1"
+	}
+	if flags.Changed("fips") {
+		config.DefaultConfig.Fips = fips
+	}
+	if flags.Changed("stage-extensions") {
+		config.DefaultConfig.Extensions = extensions
+	}
+	if flags.Changed("stage-extensions-dir") {
+		config.DefaultConfig.ExtensionsDirs = extensionDirs
+	}
+	if flags.Changed("stage-extensions-lenient") {
+		config.DefaultConfig.ExtensionsLenient = lenient
+	}
+	if flags.Changed("report") {
+		config.DefaultConfig.Report = reportPath
+	}
+	if flags.Changed("package-overlay") {
+		config.DefaultConfig.PackageOverlays = overlays
+	}
+	if flags.Changed("exclude-package") {
+		config.DefaultConfig.ExcludePackages = excludePkgs
+	}
+	if flags.Changed("add-package") {
+		config.DefaultConfig.AddPackages = addPkgs
+	}
+	if flags.Changed("optional-package") {
+		config.DefaultConfig.OptionalPackages = optionalPkgs
+	}
+	if flags.Changed("skip-package-check") {
+		config.DefaultConfig.SkipPackageCheck = skipPkgCheck
+	}
+	if flags.Changed("mirror") {
+		config.DefaultConfig.Mirrors.Repos = map[string]string{}
+		for _, m := range mirrors {
+			id, u, found := strings.Cut(m, "=")
+			if !found || id == "" {
+				return fmt.Errorf("invalid mirror %q, it has to be id=url", m)
+			}
+			config.DefaultConfig.Mirrors.Repos[id] = u
+		}
+	}
+	if flags.Changed("local-repo") {
+		config.DefaultConfig.Mirrors.Local = localRepo
+	}
+	if flags.Changed("restore-repos") {
+		config.DefaultConfig.Mirrors.Restore = restoreRepos
+	}
+	if flags.Changed("download-timeout") {
+		config.DefaultConfig.Downloads.Timeout = dlTimeout
+	}
+	if flags.Changed("download-retries") {
+		config.DefaultConfig.Downloads.Retries = dlRetries
+	}
+	if flags.Changed("ca-bundle") {
+		config.DefaultConfig.Downloads.CABundle = caBundle
+	}
+	if flags.Changed("download-cache") {
+		config.DefaultConfig.Downloads.CacheDir = dlCache
+	}
+	if flags.Changed("sbom") {
+		config.DefaultConfig.SBOM.Path = sbomPath
+	}
+	if flags.Changed("sbom-format") {
+		config.DefaultConfig.SBOM.Format = sbomFormat
+	}
+	if flags.Changed("sbom-host-path") {
+		config.DefaultConfig.SBOM.HostPath = sbomHostPath
 	}
 
 	if len(providers) > 0 {
+		// Providers from the command line replace the ones in the config file
+		config.DefaultConfig.Providers = make([]config.Provider, 0, len(providers))
 		for _, provider := range providers {
 			p := config.Provider{Name: provider}
 			flagName := fmt.Sprintf("provider-%s-version", provider)
@@ -51,12 +176,191 @@ func preRun(cmd *cobra.Command, _ []string) {
 			config.DefaultConfig.Providers = append(config.DefaultConfig.Providers, p)
 
 		}
+	}
+	if len(config.DefaultConfig.Providers) > 0 {
 		config.DefaultConfig.Variant = config.StandardVariant
 	} else {
 		config.DefaultConfig.Variant = config.CoreVariant
 	}
-	config.DefaultConfig.SkipSteps = skipStepsFlag.Value
-	config.DefaultConfig.Model = modelFlag.Value
+
+	if flags.Changed("skip-step") {
+		config.DefaultConfig.SkipSteps = skipStepsFlag.Value
+	}
+	if flags.Changed("model") || config.DefaultConfig.Model == "" {
+		config.DefaultConfig.Model = modelFlag.Value
+	}
+
+	// Values coming from the config file are not checked by the flag parsing, so check them here
+	if !slices.Contains(values.SupportedModelStrings(), config.DefaultConfig.Model) {
+		return fmt.Errorf("model %s is not included in %s", config.DefaultConfig.Model, strings.Join(values.SupportedModelStrings(), ","))
+	}
+	if err := config.DefaultConfig.Mirrors.Validate(); err != nil {
+		return err
+	}
+	if err := config.DefaultConfig.VersionOverrides.Validate(); err != nil {
+		return err
+	}
+	if err := config.DefaultConfig.Downloads.Validate(); err != nil {
+		return err
+	}
+	if !slices.Contains(config.SBOMFormats, config.DefaultConfig.SBOM.Format) {
+		return fmt.Errorf("sbom format %s is not included in %s", config.DefaultConfig.SBOM.Format, strings.Join(config.SBOMFormats, ","))
+	}
+	// Deprecated steps are still accepted so existing builds don't break, but there is nothing to skip
+	var skipSteps []string
+	for _, step := range config.DefaultConfig.SkipSteps {
+		if reason, ok := stages.DeprecatedStep(step); ok {
+			l := logger.NewKairosLogger("kairos-init", loglevelFlag.Value, false)
+			l.Logger.Warn().Str("step", step).Msgf("Skip step %s is deprecated and does nothing, %s", step, reason)
+			continue
+		}
+		if !slices.Contains(stages.GetStepNames(), step) {
+			return fmt.Errorf("skip step %s is not included in %s", step, strings.Join(stages.GetStepNames(), ","))
+		}
+		skipSteps = append(skipSteps, step)
+	}
+	config.DefaultConfig.SkipSteps = skipSteps
+	// Overlays change the package maps, so they need to be applied before any package is resolved
+	if err := values.ApplyPackageOverlays(config.DefaultConfig.PackageOverlays); err != nil {
+		return err
+	}
+	// Providers are plugins run by kairos-init itself, they would act on the running system instead of the root
+	if config.HasRoot() && len(config.DefaultConfig.Providers) > 0 && !config.ContainsSkipStep(values.BuildProviderStep) {
+		return fmt.Errorf("providers can't be run against a root, skip the %s step or run kairos-init inside the image", values.BuildProviderStep)
+	}
+	return nil
+}
+
+var extensionsCmd = &cobra.Command{
+	Use:   "extensions",
+	Short: "Work with stage extensions",
+}
+
+var extensionsLintCmd = &cobra.Command{
+	Use:   "lint <dir|bundle>...",
+	Short: "Check the stage extensions in the given dirs or bundles",
+	Long: `Check that all the yaml files in the dirs or .tar.gz bundles are valid yip files, that they only extend the stages and steps listed by steps-info and that no stage name is repeated in the same hook of a dir or bundle.
+They are loaded together in the given order, same as with --stage-extensions-dir.
+Every problem found is reported. kairos-init fails on invalid extensions, so run this before adding them to an image`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := logger.NewKairosLogger("kairos-init", "info", false)
+		// There is no system to render the extensions for, so placeholders are used for the values
+		ext, err := stages.LoadExtensions(args, stages.ExtensionPlaceholderParams(), logger)
+		if err != nil {
+			var multi *multierror.Error
+			if !errors.As(err, &multi) {
+				return err
+			}
+			for _, e := range multi.Errors {
+				logger.Logger.Error().Msg(e.Error())
+			}
+			return fmt.Errorf("found %d problems in the extensions in %s", len(multi.Errors), strings.Join(args, ", "))
+		}
+		for _, hook := range stages.ExtensionHooks() {
+			if len(ext[hook]) > 0 {
+				logger.Infof("%s: %d stages", hook, len(ext[hook]))
+			}
+		}
+		logger.Infof("The extensions in %s are valid", strings.Join(args, ", "))
+		return nil
+	},
+}
+
+var packagesCmd = &cobra.Command{
+	Use:   "packages",
+	Short: "Show the packages kairos-init would install for a system",
+	Long: `Resolve the base and kernel packages for the given distro, version, arch, model and trusted boot setting, without needing that system.
+Packages are grouped by the package map and the constraint they come from, followed by the merged list. Package overlays are applied, so they can be checked too`,
+	Example: "kairos-init packages --distro rocky --version 9.4 --arch arm64 --model generic --trusted",
+	Args:    cobra.NoArgs,
+	PreRunE: preRun,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sis, lists, err := resolvePackages(logger.NewKairosLogger("kairos-init", "info", false))
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "System: %s (%s family, %s versions) %s, model %s, trusted boot %t\n", sis.Name, sis.Family, sis.VersionScheme(), sis.Arch, config.DefaultConfig.Model, config.DefaultConfig.TrustedBoot)
+		for _, list := range lists {
+			fmt.Fprintf(out, "\n%s:\n", list.title)
+			for _, g := range list.groups {
+				if len(g.Packages) == 0 {
+					continue
+				}
+				fmt.Fprintf(out, "  %s\n", g)
+				for _, p := range g.Packages {
+					fmt.Fprintf(out, "    %s\n", p)
+				}
+			}
+			merged := values.MergePackageGroups(list.groups)
+			fmt.Fprintf(out, "  merged (%d): %s\n", len(merged), strings.Join(merged, " "))
+		}
+		return nil
+	},
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <package>",
+	Short: "Show why a package is installed on a system",
+	Long: `Show every entry of the package maps that adds the package for the given distro, version, arch, model and trusted boot setting: the map, the distro or family, arch and model keys and the constraint that matched.
+Package overlays are applied, so an overlay can be checked before using it to remove or replace the package`,
+	Example: "kairos-init explain dracut-network --distro ubuntu --version 24.04 --arch amd64",
+	Args:    cobra.ExactArgs(1),
+	PreRunE: preRun,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sis, lists, err := resolvePackages(logger.NewKairosLogger("kairos-init", "info", false))
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		found := false
+		for _, list := range lists {
+			for _, g := range values.PackageGroupsWith(list.groups, args[0]) {
+				fmt.Fprintf(out, "%s: %s\n", list.title, g)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not installed on %s %s with model %s and trusted boot %t", args[0], sis.Name, sis.Arch, config.DefaultConfig.Model, config.DefaultConfig.TrustedBoot)
+		}
+		return nil
+	},
+}
+
+// packageList is a list of packages installed by a step, grouped by where they come from
+type packageList struct {
+	title  string
+	groups []values.PackageGroup
+}
+
+// resolvePackages resolves the base and kernel packages for the system given in the flags, rendered for that system
+func resolvePackages(logger logger.KairosLogger) (values.System, []packageList, error) {
+	sis, err := system.NewSystem(pkgsDistro, pkgsVersion, values.Architecture(pkgsArch))
+	if err != nil {
+		return sis, nil, err
+	}
+	if required := values.Model(config.DefaultConfig.Model).RequiredArch(); required != "" && required != sis.Arch {
+		return sis, nil, fmt.Errorf("model %s requires the %s arch", config.DefaultConfig.Model, required)
+	}
+
+	base, err := values.GetPackageGroups(sis, logger)
+	if err != nil {
+		return sis, nil, err
+	}
+	kernel, err := values.GetKernelPackageGroups(sis, logger)
+	if err != nil {
+		return sis, nil, err
+	}
+	lists := []packageList{{title: "Base packages", groups: base}, {title: "Kernel packages", groups: kernel}}
+	for i := range lists {
+		if lists[i].groups, err = values.TemplatePackageGroups(lists[i].groups, values.GetTemplateParams(sis), logger); err != nil {
+			return sis, nil, err
+		}
+	}
+	return sis, lists, nil
 }
 
 var stepsInfo = &cobra.Command{
@@ -67,10 +371,10 @@ var stepsInfo = &cobra.Command{
 		logger := logger.NewKairosLogger("kairos-init", "info", false)
 		logger.Infof("Starting kairos-init version %s", values.GetVersion())
 		// Print the steps info in a human readable format
-		stepsInfo := values.StepsInfo()
-		logger.Infof("Step name & Description")
+		stepsInfo := stages.StepsInfo()
+		logger.Infof("Step name & Description, in the order they are run")
 		logger.Infof("--------------------------------------------------------")
-		for step, _ := range stepsInfo {
+		for step := range stepsInfo {
 			logger.Infof("\"%s\": %s", stepsInfo[step].Key, stepsInfo[step].Value)
 		}
 		logger.Infof("--------------------------------------------------------")
@@ -101,12 +405,10 @@ var versionCmd = &cobra.Command{
 }
 
 var validateCmd = &cobra.Command{
-	Use:   "validate",
-	Short: "Validate the system",
-	Long:  `Validate the system to ensure all required components are in place`,
-	PreRun: func(cmd *cobra.Command, args []string) {
-		preRun(cmd, args)
-	},
+	Use:     "validate",
+	Short:   "Validate the system",
+	Long:    `Validate the system to ensure all required components are in place`,
+	PreRunE: preRun,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Validate always logs ant info level
 		logger := logger.NewKairosLogger("kairos-init", "info", false)
@@ -118,69 +420,148 @@ var validateCmd = &cobra.Command{
 }
 
 var rootCmd = &cobra.Command{
-	Use:   "kairos-init",
-	Short: "Kairos init tool",
-	Long:  `Kairos init tool for system initialization and configuration`,
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		if runtime.GOARCH == "riscv64" && config.DefaultConfig.Fips {
-			return fmt.Errorf("FIPS is not supported on riscv64")
-		}
-		preRun(cmd, args)
-		if required := values.Model(config.DefaultConfig.Model).RequiredArch(); required != "" && required.String() != runtime.GOARCH {
-			return fmt.Errorf(
-				"model %q requires architecture %q but kairos-init is running on %q. "+
-					"You are likely cross-building without emulation: pass '--platform=linux/%s' to 'docker build' (or the equivalent for your build tool) so the base image and kairos-init run under the target architecture",
-				config.DefaultConfig.Model, required, runtime.GOARCH, required,
-			)
-		}
-		return nil
-	},
+	Use:     "kairos-init",
+	Short:   "Kairos init tool",
+	Long:    `Kairos init tool for system initialization and configuration`,
+	PreRunE: initPreRunE,
+	RunE:    runInit,
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what kairos-init would do without running it",
+	Long: `Build all the stages and print them along with the actions that are applied outside of yip (binaries, cloud configs, symlinks, provider events).
+Nothing is run or written to the system. Values that are only known after the install stage has run, like the kernel version, are shown as placeholders.
+Same as running kairos-init with --dry-run`,
+	PreRunE: initPreRunE,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		logger := logger.NewKairosLogger("kairos-init", loglevelFlag.Value, false)
-		logger.Infof("Starting kairos-init version %s", values.GetVersion())
-		logger.Debug(litter.Sdump(values.GetFullVersion()))
+		config.DefaultConfig.DryRun = true
+		return runInit(cmd, args)
+	},
+}
 
-		// Parse the version number
-		sv, err := semver.NewSemver(version)
-		if err != nil {
-			return fmt.Errorf("error parsing version: %w", err)
-		}
+// initPreRunE fills the config from the flags and checks that it can be run in this system
+func initPreRunE(cmd *cobra.Command, args []string) error {
+	if err := preRun(cmd, args); err != nil {
+		return err
+	}
+	if runtime.GOARCH == "riscv64" && config.DefaultConfig.Fips {
+		return fmt.Errorf("FIPS is not supported on riscv64")
+	}
+	if required := values.Model(config.DefaultConfig.Model).RequiredArch(); required != "" && required.String() != runtime.GOARCH {
+		return fmt.Errorf(
+			"model %q requires architecture %q but kairos-init is running on %q. "+
+				"You are likely cross-building without emulation: pass '--platform=linux/%s' to 'docker build' (or the equivalent for your build tool) so the base image and kairos-init run under the target architecture",
+			config.DefaultConfig.Model, required, runtime.GOARCH, required,
+		)
+	}
+	return nil
+}
 
-		config.DefaultConfig.KairosVersion = *sv
-		litter.Config.HidePrivateFields = false
-		logger.Debug(litter.Sdump(config.DefaultConfig))
-
-		var runStages schema.YipConfig
-
-		if stageFlag.Value != "" {
-			switch stageFlag.Value {
-			case "install":
-				runStages, err = stages.RunInstallStage(logger)
-			case "init":
-				runStages, err = stages.RunInitStage(logger)
-			case "all":
-				runStages, err = stages.RunAllStages(logger)
-			default:
-				return fmt.Errorf("unknown stage %s. Valid values are %s", stageFlag.Value, strings.Join(stageFlag.Allowed, ", "))
-			}
-		}
+// runInit runs the selected stages, or prints what they would do on dry runs
+func runInit(cmd *cobra.Command, args []string) error {
+	logger := logger.NewKairosLogger("kairos-init", loglevelFlag.Value, false)
+	if config.DefaultConfig.DryRun {
+		// Keep stdout for the plan only
+		logger.Logger = logger.Logger.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	}
+	logger.Infof("Starting kairos-init version %s", values.GetVersion())
+	logger.Debug(litter.Sdump(values.GetFullVersion()))
 
-		if err != nil {
-			logger.Error(err)
-			return err
+	// Parse the version number, the flag takes precedence over the config file
+	if !cmd.Flags().Changed("version") {
+		version = config.DefaultConfig.KairosVersion.Original()
+	}
+	if version == "" {
+		return fmt.Errorf("version is required, set it with --version or in the config file")
+	}
+	sv, err := semver.NewSemver(version)
+	if err != nil {
+		return fmt.Errorf("error parsing version: %w", err)
+	}
+
+	config.DefaultConfig.KairosVersion = *sv
+	litter.Config.HidePrivateFields = false
+	logger.Debug(litter.Sdump(config.DefaultConfig))
+
+	// Check the skipped steps before running anything
+	if err = stages.ValidateSkipSteps(stageFlag.Value, logger); err != nil {
+		return fmt.Errorf("invalid steps to skip: %w", err)
+	}
+
+	if config.DefaultConfig.DryRun {
+		return printPlan(logger)
+	}
+
+	var runStages schema.YipConfig
+
+	if stageFlag.Value != "" {
+		switch stageFlag.Value {
+		case "install":
+			runStages, err = stages.RunInstallStage(logger)
+		case "init":
+			runStages, err = stages.RunInitStage(logger)
+		case "all":
+			runStages, err = stages.RunAllStages(logger)
+		default:
+			return fmt.Errorf("unknown stage %s. Valid values are %s", stageFlag.Value, strings.Join(stageFlag.Allowed, ", "))
 		}
+	}
 
-		litter.Config.HideZeroValues = true
-		litter.Config.HidePrivateFields = true
-		// Save the stages to a file for debugging and future use
-		if stageFlag.Value == "all" {
-			_ = os.WriteFile("/etc/kairos/kairos-init-all-stage.yaml", []byte(runStages.ToString()), 0644)
-		} else {
-			_ = os.WriteFile(fmt.Sprintf("/etc/kairos/kairos-init-%s-stage.yaml", stageFlag.Value), []byte(runStages.ToString()), 0644)
+	if config.DefaultConfig.Report != "" {
+		if reportErr := stages.WriteReport(config.DefaultConfig.Report, err); reportErr != nil {
+			logger.Logger.Warn().Err(reportErr).Msg("Failed to write the report")
 		}
+	}
 
-		return nil
-	},
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	litter.Config.HideZeroValues = true
+	litter.Config.HidePrivateFields = true
+	// Save the stages to a file for debugging and future use
+	if stageFlag.Value == "all" {
+		_ = os.WriteFile(config.RootPath("/etc/kairos/kairos-init-all-stage.yaml"), []byte(runStages.ToString()), 0644)
+	} else {
+		_ = os.WriteFile(config.RootPath(fmt.Sprintf("/etc/kairos/kairos-init-%s-stage.yaml", stageFlag.Value)), []byte(runStages.ToString()), 0644)
+	}
+
+	return nil
+}
+
+// printPlan builds the selected stages without running them and prints them to stdout in the selected output format
+func printPlan(logger logger.KairosLogger) error {
+	var plan stages.Plan
+	var err error
+
+	switch stageFlag.Value {
+	case "install":
+		plan, err = stages.PlanInstallStage(logger)
+	case "init":
+		plan, err = stages.PlanInitStage(logger)
+	case "all":
+		plan, err = stages.PlanAllStages(logger)
+	default:
+		return fmt.Errorf("unknown stage %s. Valid values are %s", stageFlag.Value, strings.Join(stageFlag.Allowed, ", "))
+	}
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	var out string
+	if outputFlag.Value == "json" {
+		out, err = plan.ToJSON()
+	} else {
+		out, err = plan.ToYAML()
+	}
+	if err != nil {
+		return fmt.Errorf("error rendering the plan: %w", err)
+	}
+	fmt.Println(out)
+	return nil
 }
 
 func getProvidersFromArgs() []string {
@@ -202,38 +583,73 @@ func getProvidersFromArgs() []string {
 }
 
 func init() {
+	addInitFlags(rootCmd)
+	addInitFlags(planCmd)
+	rootCmd.Flags().BoolVar(&config.DefaultConfig.DryRun, "dry-run", false, "do not run anything, print what would be done instead. Same as the plan command")
+	rootCmd.Flags().StringVar(&reportPath, "report", config.DefaultReportPath, "path of the json report of the run in the target system, empty to disable it")
+	rootCmd.Flags().BoolVar(&config.DefaultConfig.Resume, "resume", false, "skip the steps that already completed with the same inputs in a previous run, starting from the first one that did not")
+	rootCmd.Flags().VarP(outputFlag, "output", "o", fmt.Sprintf("output format for --dry-run (%s)", strings.Join(outputFlag.Allowed, ", ")))
+	planCmd.Flags().VarP(outputFlag, "output", "o", fmt.Sprintf("output format for the plan (%s)", strings.Join(outputFlag.Allowed, ", ")))
+
+	addSharedFlags(rootCmd)
+	addSharedFlags(planCmd)
+	addSharedFlags(validateCmd)
+	addSharedFlags(packagesCmd)
+	addSharedFlags(explainCmd)
+	addPackagesFlags(packagesCmd)
+	addPackagesFlags(explainCmd)
+
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(stepsInfo)
+	rootCmd.AddCommand(packagesCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(planCmd)
+	extensionsCmd.AddCommand(extensionsLintCmd)
+	rootCmd.AddCommand(extensionsCmd)
+}
+
+// addInitFlags adds the flags that configure the init process to the given command
+func addInitFlags(cmd *cobra.Command) {
 	// Dynamic provider flag setup
 	provs := getProvidersFromArgs()
 	if len(provs) > 0 {
 		for _, provider := range provs {
 			flagName := fmt.Sprintf("provider-%s-version", provider)
-			rootCmd.Flags().String(flagName, "", fmt.Sprintf("Version for provider %s", provider))
+			cmd.Flags().String(flagName, "", fmt.Sprintf("Version for provider %s", provider))
 			flagConfig := fmt.Sprintf("provider-%s-config", provider)
-			rootCmd.Flags().String(flagConfig, "", fmt.Sprintf("Config file for provider %s", provider))
+			cmd.Flags().String(flagConfig, "", fmt.Sprintf("Config file for provider %s", provider))
 		}
 	} else {
-		rootCmd.Flags().String("provider-$NAME-version", "", "Version for provider $NAME set by --provider/-p flag")
-		rootCmd.Flags().String("provider-$NAME-config", "", "Config for provider $NAME set by --provider/-p flag")
+		cmd.Flags().String("provider-$NAME-version", "", "Version for provider $NAME set by --provider/-p flag")
+		cmd.Flags().String("provider-$NAME-config", "", "Config for provider $NAME set by --provider/-p flag")
 	}
 	// enum flags
-	rootCmd.Flags().VarP(stageFlag, "stage", "s", fmt.Sprintf("set the stage to run (%s)", strings.Join(stageFlag.Allowed, ", ")))
-	rootCmd.Flags().VarP(loglevelFlag, "level", "l", fmt.Sprintf("set the log level (%s)", strings.Join(loglevelFlag.Allowed, ", ")))
+	cmd.Flags().VarP(stageFlag, "stage", "s", fmt.Sprintf("set the stage to run (%s)", strings.Join(stageFlag.Allowed, ", ")))
+	cmd.Flags().VarP(loglevelFlag, "level", "l", fmt.Sprintf("set the log level (%s)", strings.Join(loglevelFlag.Allowed, ", ")))
 	// rest of the flags
-	rootCmd.Flags().VarP(modelFlag, "model", "m", fmt.Sprintf("model to build for (%s)", strings.Join(modelFlag.Allowed, ", ")))
-	rootCmd.Flags().StringSliceVarP(&providers, "provider", "p", []string{}, fmt.Sprintf("Provider plugin (repeatable)"))
-	rootCmd.Flags().BoolVar(&config.DefaultConfig.Fips, "fips", false, "use fips kairos binary versions. For FIPS 140-2 compliance images")
-	rootCmd.Flags().StringVarP(&version, "version", "v", "", "set a version number to use for the generated system. Its used to identify this system for upgrades and such. Required.")
-	rootCmd.Flags().BoolVarP(&config.DefaultConfig.Extensions, "stage-extensions", "x", false, "enable stage extensions mode")
-	rootCmd.Flags().Var(skipStepsFlag, "skip-step", "Skip one or more steps. Valid values are: "+strings.Join(skipStepsFlag.Allowed, ", ")+". You can pass multiple values separated by commas, for example: --skip-step initrd,workarounds")
-	// Mark required flags
-	_ = rootCmd.MarkFlagRequired("version")
-
-	addSharedFlags(rootCmd)
-	addSharedFlags(validateCmd)
-
-	rootCmd.AddCommand(validateCmd)
-	rootCmd.AddCommand(stepsInfo)
-	rootCmd.AddCommand(versionCmd)
+	cmd.Flags().VarP(modelFlag, "model", "m", fmt.Sprintf("model to build for (%s)", strings.Join(modelFlag.Allowed, ", ")))
+	cmd.Flags().StringSliceVarP(&providers, "provider", "p", []string{}, "Provider plugin (repeatable)")
+	cmd.Flags().BoolVar(&fips, "fips", false, "use fips kairos binary versions. For FIPS 140-2 compliance images")
+	cmd.Flags().StringVarP(&version, "version", "v", "", "set a version number to use for the generated system. Its used to identify this system for upgrades and such. Required if not set in the config file.")
+	cmd.Flags().BoolVarP(&extensions, "stage-extensions", "x", false, "enable stage extensions mode")
+	cmd.Flags().StringArrayVar(&extensionDirs, "stage-extensions-dir", nil, "dir or .tar.gz bundle to load the stage extensions from (repeatable). They are loaded in order and later ones can override stages of earlier ones by name")
+	cmd.Flags().BoolVar(&lenient, "stage-extensions-lenient", false, "log and ignore invalid stage extensions instead of failing")
+	cmd.Flags().StringArrayVar(&excludePkgs, "exclude-package", nil, "package to not install even if kairos-init would (repeatable)")
+	cmd.Flags().StringArrayVar(&addPkgs, "add-package", nil, "extra package to install along with the base packages (repeatable)")
+	cmd.Flags().StringArrayVar(&optionalPkgs, "optional-package", nil, "package that is only installed if it is available in the repositories (repeatable)")
+	cmd.Flags().BoolVar(&skipPkgCheck, "skip-package-check", false, "don't check that all the packages are available before installing them")
+	cmd.Flags().StringArrayVar(&mirrors, "mirror", nil, "id=url of a mirror to use for the repositories (repeatable). The id is a known upstream (ubuntu, debian, alpine, opensuse...) or a dnf/zypper repository id")
+	cmd.Flags().StringVar(&localRepo, "local-repo", "", "dir of the target system with a package repository to add along with the others")
+	cmd.Flags().BoolVar(&restoreRepos, "restore-repos", false, "put back the original repositories once the packages are installed")
+	cmd.Flags().DurationVar(&dlTimeout, "download-timeout", config.DefaultDownloadTimeout, "timeout of each attempt to download a binary, 0 for none")
+	cmd.Flags().IntVar(&dlRetries, "download-retries", config.DefaultDownloadRetries, "times to retry a failed download, with an exponential backoff")
+	cmd.Flags().StringVar(&caBundle, "ca-bundle", "", "PEM file with the CAs to trust for the downloads along with the system ones")
+	cmd.Flags().StringVar(&dlCache, "download-cache", "", "dir to keep the verified downloads in, so they are not downloaded again. It can be a BuildKit cache mount")
+	cmd.Flags().StringVar(&sbomPath, "sbom", config.DefaultSBOMPath, "path of the SBOM in the target system, empty to not write it there")
+	cmd.Flags().StringVar(&sbomFormat, "sbom-format", config.SBOMSPDX, fmt.Sprintf("format of the SBOM (%s)", strings.Join(config.SBOMFormats, ", ")))
+	cmd.Flags().StringVar(&sbomHostPath, "sbom-host-path", "", "also write the SBOM to this path of the running system, to get it out of the root or container")
+	cmd.Flags().Var(skipStepsFlag, "skip-step", "Skip one or more steps. Valid values are: "+strings.Join(stages.GetStepNames(), ", ")+". You can pass multiple values separated by commas, for example: --skip-step initrd,workarounds")
 }
 
 func main() {
@@ -242,9 +658,24 @@ func main() {
 	}
 }
 
+// addPackagesFlags adds the flags that select the system to resolve the packages for
+func addPackagesFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&pkgsDistro, "distro", "", "distro to resolve the packages for, as the ID in its os-release")
+	cmd.Flags().StringVar(&pkgsVersion, "version", "", "version of the distro, as the VERSION_ID in its os-release. Not needed for rolling releases without one")
+	cmd.Flags().StringVar(&pkgsArch, "arch", runtime.GOARCH, "arch to resolve the packages for")
+	cmd.Flags().VarP(modelFlag, "model", "m", fmt.Sprintf("model to resolve the packages for (%s)", strings.Join(modelFlag.Allowed, ", ")))
+	_ = cmd.MarkFlagRequired("distro")
+	// A bare --trusted resolves the packages for trusted boot, --trusted=false is still accepted. The commands that
+	// build a system keep requiring the value, as existing builds pass it as -t "${TRUSTED_BOOT}"
+	cmd.Flags().Lookup("trusted").NoOptDefVal = "true"
+}
+
 // Shared flags are flags that are used in multiple commands
 func addSharedFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&configFile, "config", "c", "", "load the configuration from a yaml file. Flags and environment variables take precedence over it")
+	cmd.Flags().StringVar(&rootDir, "root", "", "work on the system mounted at this path instead of the running one. Commands are run chrooted into it, so it needs /proc, /sys and /dev mounted")
 	cmd.Flags().StringVarP(&trusted, "trusted", "t", "false", "init the system for Trusted Boot, changes bootloader to systemd")
+	cmd.Flags().StringArrayVar(&overlays, "package-overlay", nil, "yaml file that adds, removes or replaces packages in the package maps (repeatable). They are applied in order")
 }
 
 type enum struct {
@@ -1,45 +1,264 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"text/template"
+	"time"
 
 	semver "github.com/hashicorp/go-version"
+	"github.com/twpayne/go-vfs/v5"
 	"gopkg.in/yaml.v3"
 )
 
 // Config is the struct to track the config of the init image
 // So we can access it from anywhere
+// It can be loaded from a file with LoadFile, the yaml keys map 1:1 to the fields
 type Config struct {
-	Model            string
-	Variant          Variant
-	TrustedBoot      bool
-	Fips             bool
-	Providers        []Provider
-	KairosVersion    semver.Version
-	Extensions       bool
-	VersionOverrides VersionOverrides
-	SkipSteps        []string
+	Model             string           `yaml:"model,omitempty"`
+	Variant           Variant          `yaml:"-"` // Set depending on the providers
+	TrustedBoot       bool             `yaml:"trusted_boot,omitempty"`
+	Fips              bool             `yaml:"fips,omitempty"`
+	Providers         []Provider       `yaml:"providers,omitempty"`
+	KairosVersion     semver.Version   `yaml:"version,omitempty"`
+	Extensions        bool             `yaml:"stage_extensions,omitempty"`
+	ExtensionsDirs    PathList         `yaml:"stage_extensions_dir,omitempty"`     // Dirs or bundles, in the order they are loaded
+	ExtensionsLenient bool             `yaml:"stage_extensions_lenient,omitempty"` // Ignore invalid extensions instead of failing
+	VersionOverrides  VersionOverrides `yaml:"version_overrides,omitempty"`
+	PackageOverlays   PathList         `yaml:"package_overlays,omitempty"`   // Files changing the package maps, applied in order
+	ExcludePackages   []string         `yaml:"exclude_packages,omitempty"`   // Packages not installed even if the package maps have them
+	AddPackages       []string         `yaml:"add_packages,omitempty"`       // Packages installed along with the base packages
+	OptionalPackages  []string         `yaml:"optional_packages,omitempty"`  // Packages left out if they are not available
+	SkipPackageCheck  bool             `yaml:"skip_package_check,omitempty"` // Don't check the packages are available before installing them
+	SkipSteps         []string         `yaml:"skip_steps,omitempty"`
+	Nvidia            Nvidia           `yaml:"nvidia,omitempty"`
+	Mirrors           Mirrors          `yaml:"mirrors,omitempty"`
+	Downloads         Downloads        `yaml:"downloads,omitempty"`
+	DryRun            bool             `yaml:"-"`                // Only build the stages and actions, never apply them
+	Resume            bool             `yaml:"-"`                // Skip the steps that already completed with the same inputs
+	Report            string           `yaml:"report,omitempty"` // Path of the json report in the target system, empty to disable it
+	SBOM              SBOM             `yaml:"sbom,omitempty"`   // Software bill of materials of the system
+	Root              string           `yaml:"root,omitempty"`   // Root of the target system, empty or / for the running system
 }
 
 type Provider struct {
-	Name    string
-	Version string
-	Config  string
+	Name    string `yaml:"name"`
+	Version string `yaml:"version,omitempty"`
+	Config  string `yaml:"config,omitempty"`
 }
 
+// Nvidia holds the settings used to set up the NVIDIA repositories and packages for the NVIDIA models
+// Empty values fall back to the defaults for the selected model
+type Nvidia struct {
+	Release    string `yaml:"release,omitempty"`     // NVIDIA_RELEASE
+	Version    string `yaml:"version,omitempty"`     // NVIDIA_VERSION
+	L4TVersion string `yaml:"l4t_version,omitempty"` // L4T_VERSION
+	BoardModel string `yaml:"board_model,omitempty"` // BOARD_MODEL
+}
+
+// Mirrors points the package managers to other repositories, for builds without access to the upstream ones
+type Mirrors struct {
+	Repos   map[string]string `yaml:"repos,omitempty"`   // Base url by upstream or repository id
+	Local   string            `yaml:"local,omitempty"`   // Dir of the target system with a repository, added as a local one
+	Restore bool              `yaml:"restore,omitempty"` // Put back the original repositories once the packages are installed
+}
+
+// Enabled returns true if there is any mirror or local repository to set up
+func (m Mirrors) Enabled() bool {
+	return len(m.Repos) > 0 || m.Local != ""
+}
+
+// Validate checks the mirror urls and the local repository dir
+// Urls end up in the repository files and the commands that edit them, so they can't have quotes, spaces or #
+func (m Mirrors) Validate() error {
+	for id, u := range m.Repos {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" || (parsed.Host == "" && parsed.Scheme != "file") {
+			return fmt.Errorf("invalid url %q for the %s mirror", u, id)
+		}
+		if strings.ContainsAny(u, "'\"# \t\n") {
+			return fmt.Errorf("invalid url %q for the %s mirror, it can't have quotes, spaces or #", u, id)
+		}
+	}
+	if m.Local != "" && (!filepath.IsAbs(m.Local) || strings.ContainsAny(m.Local, "'\"# \t\n")) {
+		return fmt.Errorf("invalid local repository %q, it has to be an absolute path without quotes, spaces or #", m.Local)
+	}
+	return nil
+}
+
+// Downloads sets how the binaries are downloaded
+type Downloads struct {
+	Timeout  time.Duration `yaml:"timeout,omitempty"`   // Timeout of each attempt, 0 for none
+	Retries  int           `yaml:"retries,omitempty"`   // Attempts after the first one, with an exponential backoff
+	CABundle string        `yaml:"ca_bundle,omitempty"` // PEM file with the CAs to trust along with the system ones
+	CacheDir string        `yaml:"cache_dir,omitempty"` // Dir in the running system to keep the downloads in, empty for no cache
+}
+
+// The download defaults
+const (
+	DefaultDownloadTimeout = 5 * time.Minute
+	DefaultDownloadRetries = 3
+)
+
+// Validate checks the timeout, the retries and that the CA bundle can be read
+func (d Downloads) Validate() error {
+	if d.Timeout < 0 {
+		return fmt.Errorf("invalid download timeout %s", d.Timeout)
+	}
+	if d.Retries < 0 {
+		return fmt.Errorf("invalid download retries %d", d.Retries)
+	}
+	if d.CABundle != "" {
+		if _, err := os.Stat(d.CABundle); err != nil {
+			return fmt.Errorf("invalid CA bundle: %w", err)
+		}
+	}
+	return nil
+}
+
+// SBOM sets how and where the software bill of materials of the system is written
+type SBOM struct {
+	Format   string `yaml:"format,omitempty"`    // SBOMSPDX or SBOMCycloneDX
+	Path     string `yaml:"path,omitempty"`      // Path in the target system, empty to not write it there
+	HostPath string `yaml:"host_path,omitempty"` // Path in the running system, to get it out of a root or container
+}
+
+// The SBOM formats
+const (
+	SBOMSPDX      = "spdx"      // SPDX 2.3 json
+	SBOMCycloneDX = "cyclonedx" // CycloneDX 1.5 json
+)
+
+// SBOMFormats are the supported SBOM formats
+var SBOMFormats = []string{SBOMSPDX, SBOMCycloneDX}
+
 // VersionOverrides holds version overrides for binaries
+// Each one is a release version, a url to download the binary from or a local path to it
 type VersionOverrides struct {
 	Agent            string `yaml:"agent,omitempty"`
 	Immucore         string `yaml:"immucore,omitempty"`
 	KcryptChallenger string `yaml:"kcrypt_challenger,omitempty"`
 	Provider         string `yaml:"provider,omitempty"`
 	EdgeVpn          string `yaml:"edgevpn,omitempty"`
+	// Checksums are the sha256 of the downloads by the key of their version, like agent. Without one, the download is
+	// checked against the checksums file of the release
+	Checksums map[string]string `yaml:"checksums,omitempty"`
+	PublicKey string            `yaml:"public_key,omitempty"` // GPG or cosign key the checksums file of the releases is signed with
+	// URLTemplates are the Go templates of the urls the release versions are downloaded from, by the key of their
+	// version or DefaultURLTemplate for all of them, rendered with a ReleaseURLVars. Without one, they are
+	// downloaded from the GitHub releases.
+	URLTemplates map[string]string `yaml:"url_templates,omitempty"`
+	// ArchivePaths are the paths of the binaries in their archives, by the key of their version, for archives with
+	// more than one file with the name of the binary
+	ArchivePaths map[string]string `yaml:"archive_paths,omitempty"`
+}
+
+// The keys of the binaries in the version overrides
+const (
+	AgentBinary            = "agent"
+	ImmucoreBinary         = "immucore"
+	KcryptChallengerBinary = "kcrypt_challenger"
+	ProviderBinary         = "provider"
+	EdgeVpnBinary          = "edgevpn"
+)
+
+// OverrideBinaries are the keys of the binaries that can be overridden
+var OverrideBinaries = []string{AgentBinary, ImmucoreBinary, KcryptChallengerBinary, ProviderBinary, EdgeVpnBinary}
+
+// DefaultURLTemplate is the key of the url template used for the binaries without their own
+const DefaultURLTemplate = "default"
+
+// ReleaseURLVars are the variables of the url templates
+type ReleaseURLVars struct {
+	Repo      string // Name of the repository, like kairos-agent
+	Org       string // GitHub org of the repository, like kairos-io
+	Version   string // The overridden version
+	Arch      string // amd64 or arm64
+	ArchAlias string // x86_64 for amd64, the same as Arch otherwise
+	Fips      string // -fips for the fips builds, empty otherwise
+}
+
+// ReleaseURL renders the url template for the binary with the given variables, returning false if it has none
+func (v VersionOverrides) ReleaseURL(binary string, vars ReleaseURLVars) (string, bool, error) {
+	tmpl, ok := v.URLTemplates[binary]
+	if !ok {
+		if tmpl, ok = v.URLTemplates[DefaultURLTemplate]; !ok {
+			return "", false, nil
+		}
+	}
+	t, err := template.New(binary).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", true, fmt.Errorf("invalid url template for %s: %w", binary, err)
+	}
+	var out strings.Builder
+	if err = t.Execute(&out, vars); err != nil {
+		return "", true, fmt.Errorf("invalid url template for %s: %w", binary, err)
+	}
+	return out.String(), true, nil
+}
+
+// Validate checks that the checksums, url templates and archive paths are for known binaries, that the templates
+// render and that the archive paths are inside the archives
+func (v VersionOverrides) Validate() error {
+	for binary := range v.Checksums {
+		if !slices.Contains(OverrideBinaries, binary) {
+			return fmt.Errorf("checksum for unknown binary %s, expected one of %s", binary, strings.Join(OverrideBinaries, ","))
+		}
+	}
+	for binary, p := range v.ArchivePaths {
+		if !slices.Contains(OverrideBinaries, binary) {
+			return fmt.Errorf("archive path for unknown binary %s, expected one of %s", binary, strings.Join(OverrideBinaries, ","))
+		}
+		if clean := path.Clean(p); p == "" || path.IsAbs(p) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("invalid archive path %q for %s, it has to be a relative path inside the archive", p, binary)
+		}
+	}
+	for binary := range v.URLTemplates {
+		if binary != DefaultURLTemplate && !slices.Contains(OverrideBinaries, binary) {
+			return fmt.Errorf("url template for unknown binary %s, expected one of %s,%s", binary, strings.Join(OverrideBinaries, ","), DefaultURLTemplate)
+		}
+		if _, _, err := v.ReleaseURL(binary, ReleaseURLVars{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 var DefaultConfig = Config{
 	Providers: make([]Provider, 0),
+	Report:    DefaultReportPath,
+	SBOM:      SBOM{Format: SBOMSPDX, Path: DefaultSBOMPath},
+	Downloads: Downloads{Timeout: DefaultDownloadTimeout, Retries: DefaultDownloadRetries},
+}
+
+// DefaultReportPath is where the report of the run is written by default
+const DefaultReportPath = "/etc/kairos/kairos-init-report.json"
+
+// DefaultSBOMPath is where the SBOM of the system is written by default
+const DefaultSBOMPath = "/etc/kairos/kairos-sbom.json"
+
+// PathList is a list of paths, in the config file it can also be a single string in the path list format of the
+// system, like PATH
+type PathList []string
+
+func (p *PathList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = filepath.SplitList(value.Value)
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
 }
 
 type Variant string
@@ -82,9 +301,80 @@ func (c *Config) LoadVersionOverrides() {
 	}
 }
 
+// LoadFile loads a kairos-init config file on top of the current config
+// Only the keys present in the file are changed, unknown keys are an error so typos don't go unnoticed
+func (c *Config) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envVars maps the environment variables that kairos-init reads to the config fields they set
+func (c *Config) envVars() map[string]*string {
+	return map[string]*string{
+		"NVIDIA_RELEASE": &c.Nvidia.Release,
+		"NVIDIA_VERSION": &c.Nvidia.Version,
+		"L4T_VERSION":    &c.Nvidia.L4TVersion,
+		"BOARD_MODEL":    &c.Nvidia.BoardModel,
+	}
+}
+
+// envPathLists maps the environment variables with a path list to the config fields they set
+func (c *Config) envPathLists() map[string]*PathList {
+	return map[string]*PathList{
+		"KAIROS_INIT_STAGE_EXTENSIONS_DIR": &c.ExtensionsDirs,
+		"KAIROS_INIT_PACKAGE_OVERLAYS":     &c.PackageOverlays,
+	}
+}
+
+// LoadEnv sets the config fields from their environment variables, if set
+func (c *Config) LoadEnv() {
+	for key, field := range c.envVars() {
+		if value, exists := os.LookupEnv(key); exists {
+			*field = value
+		}
+	}
+	for key, field := range c.envPathLists() {
+		if value, exists := os.LookupEnv(key); exists {
+			*field = filepath.SplitList(value)
+		}
+	}
+}
+
 func init() {
 	// Attempt to load version overrides during initialization
 	DefaultConfig.LoadVersionOverrides()
+	DefaultConfig.LoadEnv()
+}
+
+// HasRoot returns true if kairos-init is working on a target root instead of the running system
+func HasRoot() bool {
+	return DefaultConfig.Root != "" && filepath.Clean(DefaultConfig.Root) != "/"
+}
+
+// RootPath returns where the given path of the target system is found in the running system
+func RootPath(path string) string {
+	if !HasRoot() {
+		return path
+	}
+	return filepath.Join(DefaultConfig.Root, path)
+}
+
+// RootFS returns the filesystem of the target system
+func RootFS() vfs.FS {
+	if !HasRoot() {
+		return vfs.OSFS
+	}
+	return vfs.NewPathFS(vfs.OSFS, DefaultConfig.Root)
 }
 
 // ContainsSkipStep checks if a step is in the skip steps list
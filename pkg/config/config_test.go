@@ -0,0 +1,200 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kairos-init.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfigFile(t, `
+version: v3.5.0
+model: rpi4
+fips: true
+providers:
+  - name: kairos
+    version: v2.10.0
+skip_steps: [kernel, initrd]
+version_overrides:
+  agent: v2.20.0
+nvidia:
+  l4t_version: "36.5"
+downloads:
+  timeout: 90s
+  cache_dir: /cache
+`)
+	c := Config{ExtensionsDirs: PathList{"/keep/me"}, VersionOverrides: VersionOverrides{Immucore: "v0.1.0"}}
+	if err := c.LoadFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.KairosVersion.Original() != "v3.5.0" {
+		t.Errorf("expected version v3.5.0, got %q", c.KairosVersion.Original())
+	}
+	if c.Model != "rpi4" || !c.Fips {
+		t.Errorf("expected model rpi4 with fips, got %q fips=%v", c.Model, c.Fips)
+	}
+	if len(c.Providers) != 1 || c.Providers[0].Name != "kairos" || c.Providers[0].Version != "v2.10.0" {
+		t.Errorf("unexpected providers: %+v", c.Providers)
+	}
+	if len(c.SkipSteps) != 2 {
+		t.Errorf("unexpected skip steps: %v", c.SkipSteps)
+	}
+	if c.Nvidia.L4TVersion != "36.5" {
+		t.Errorf("expected l4t version 36.5, got %q", c.Nvidia.L4TVersion)
+	}
+	if c.Downloads.Timeout != 90*time.Second || c.Downloads.CacheDir != "/cache" {
+		t.Errorf("unexpected downloads: %+v", c.Downloads)
+	}
+	// Keys not present in the file keep their previous values
+	if len(c.ExtensionsDirs) != 1 || c.ExtensionsDirs[0] != "/keep/me" || c.VersionOverrides.Immucore != "v0.1.0" || c.VersionOverrides.Agent != "v2.20.0" {
+		t.Errorf("unexpected merge result: dirs=%q overrides=%+v", c.ExtensionsDirs, c.VersionOverrides)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown key", content: "modle: generic\n"},
+		{name: "invalid version", content: "version: not-a-version\n"},
+		{name: "invalid yaml", content: "providers: {\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{}
+			if err := c.LoadFile(writeConfigFile(t, tt.content)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+
+	c := Config{}
+	if err := c.LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	if err := c.LoadFile(writeConfigFile(t, "")); err != nil {
+		t.Errorf("expected an empty file to be valid, got %v", err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("L4T_VERSION", "39.3")
+	t.Setenv("KAIROS_INIT_STAGE_EXTENSIONS_DIR", "/from/env"+string(filepath.ListSeparator)+"/board.tar.gz")
+	c := Config{ExtensionsDirs: PathList{"/from/file"}, Nvidia: Nvidia{L4TVersion: "36.4", BoardModel: "t234"}}
+	c.LoadEnv()
+
+	if c.Nvidia.L4TVersion != "39.3" || len(c.ExtensionsDirs) != 2 || c.ExtensionsDirs[0] != "/from/env" || c.ExtensionsDirs[1] != "/board.tar.gz" {
+		t.Errorf("expected env to override the config, got %+v", c)
+	}
+	if c.Nvidia.BoardModel != "t234" {
+		t.Errorf("expected unset env vars to keep the config value, got %q", c.Nvidia.BoardModel)
+	}
+}
+
+func TestLoadFileExtensionsDirs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{name: "single dir", content: "stage_extensions_dir: /base\n", want: []string{"/base"}},
+		{name: "path list", content: "stage_extensions_dir: /base:/board\n", want: []string{"/base", "/board"}},
+		{name: "list", content: "stage_extensions_dir:\n  - /base\n  - /board.tar.gz\n", want: []string{"/base", "/board.tar.gz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{}
+			if err := c.LoadFile(writeConfigFile(t, tt.content)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(c.ExtensionsDirs) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, c.ExtensionsDirs)
+			}
+			for i := range tt.want {
+				if c.ExtensionsDirs[i] != tt.want[i] {
+					t.Errorf("expected %v, got %v", tt.want, c.ExtensionsDirs)
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorsValidate(t *testing.T) {
+	valid := Mirrors{Repos: map[string]string{"ubuntu": "http://mirror.local/ubuntu", "epel": "file:///srv/epel/$releasever/"}, Local: "/srv/repo"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, m := range []Mirrors{
+		{Repos: map[string]string{"ubuntu": "mirror.local/ubuntu"}},
+		{Repos: map[string]string{"ubuntu": "http://mirror.local/ubuntu'; rm -rf /"}},
+		{Local: "srv/repo"},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", m)
+		}
+	}
+}
+
+func TestVersionOverridesURLTemplates(t *testing.T) {
+	overrides := VersionOverrides{URLTemplates: map[string]string{
+		DefaultURLTemplate: "https://mirror.local/{{.Repo}}/{{.Version}}/{{.Repo}}-{{.ArchAlias}}{{.Fips}}.tar.gz",
+		EdgeVpnBinary:      "https://mirror.local/{{.Org}}/edgevpn-{{.Version}}-{{.Arch}}.tar.gz",
+	}}
+	overrides.ArchivePaths = map[string]string{AgentBinary: "linux-amd64/kairos-agent"}
+	if err := overrides.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vars := ReleaseURLVars{Repo: "kairos-agent", Org: "kairos-io", Version: "v2.20.0", Arch: "amd64", ArchAlias: "x86_64", Fips: "-fips"}
+	url, ok, err := overrides.ReleaseURL(AgentBinary, vars)
+	if err != nil || !ok || url != "https://mirror.local/kairos-agent/v2.20.0/kairos-agent-x86_64-fips.tar.gz" {
+		t.Errorf("unexpected url %q, %v, %v", url, ok, err)
+	}
+	url, _, _ = overrides.ReleaseURL(EdgeVpnBinary, ReleaseURLVars{Org: "mudler", Version: "v0.30.0", Arch: "arm64"})
+	if url != "https://mirror.local/mudler/edgevpn-v0.30.0-arm64.tar.gz" {
+		t.Errorf("unexpected edgevpn url %q", url)
+	}
+	if _, ok, _ = (VersionOverrides{}).ReleaseURL(AgentBinary, vars); ok {
+		t.Errorf("expected no url without templates")
+	}
+
+	for _, o := range []VersionOverrides{
+		{URLTemplates: map[string]string{"kairos-agent": "https://mirror.local"}},
+		{URLTemplates: map[string]string{AgentBinary: "https://mirror.local/{{.Repository}}"}},
+		{URLTemplates: map[string]string{AgentBinary: "https://mirror.local/{{.Repo"}},
+		{Checksums: map[string]string{"kairos-agent": "abc"}},
+		{ArchivePaths: map[string]string{"kairos-agent": "bin/kairos-agent"}},
+		{ArchivePaths: map[string]string{AgentBinary: "../kairos-agent"}},
+		{ArchivePaths: map[string]string{AgentBinary: "/bin/kairos-agent"}},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
+
+func TestDownloadsValidate(t *testing.T) {
+	if err := DefaultConfig.Downloads.Validate(); err != nil {
+		t.Errorf("unexpected error for the defaults: %v", err)
+	}
+	for _, d := range []Downloads{
+		{Timeout: -time.Second},
+		{Retries: -1},
+		{CABundle: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if err := d.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", d)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package kernel
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -11,11 +12,12 @@ import (
 	"github.com/kairos-io/kairos-sdk/types/logger"
 )
 
-// GetLatest returns the latest kernel version installed under /lib/modules for
-// the given model. It is the standard production entry-point; use
+// GetLatest returns the latest kernel version installed under /lib/modules of
+// the given root for the given model. It is the standard production
+// entry-point, pass "/" as root for the running system; use
 // GetLatestFromPath when you need to inject a custom path (e.g. in tests).
-func GetLatest(model string, l logger.KairosLogger) (string, error) {
-	return GetLatestFromPath("/lib/modules", model, l)
+func GetLatest(root, model string, l logger.KairosLogger) (string, error) {
+	return GetLatestFromPath(filepath.Join(root, "/lib/modules"), model, l)
 }
 
 // GetLatestFromPath returns the latest kernel version found under modulesPath
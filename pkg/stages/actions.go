@@ -0,0 +1,74 @@
+package stages
+
+import (
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// ActionKind identifies what an Action does to the system
+type ActionKind string
+
+const (
+	ActionWriteFile     ActionKind = "write"          // Writes embedded content into Dest
+	ActionDownload      ActionKind = "download"       // Downloads Source and extracts the binary into Dest
+	ActionCopy          ActionKind = "copy"           // Copies the local binary, archive or directory with it in Source into Dest
+	ActionSymlink       ActionKind = "symlink"        // Links Dest to Source
+	ActionProviderEvent ActionKind = "provider-event" // Publishes the build-install event to the providers in Source
+	ActionExtension     ActionKind = "extension"      // Runs the Stages of the extension hook in Source
+	ActionSBOM          ActionKind = "sbom"           // Writes the SBOM of the system in the Source format into Dest
+	ActionSBOMHost      ActionKind = "sbom-host"      // Same as ActionSBOM, but Dest is in the running system
+)
+
+// Action is a change that kairos-init applies directly to the system instead of through a yip stage,
+// like dumping the bundled binaries or the cloud configs.
+// Steps return them instead of applying them right away so they can be listed in a plan without touching anything.
+type Action struct {
+	Step     string         `yaml:"step" json:"step"`
+	Kind     ActionKind     `yaml:"kind" json:"kind"`
+	Source   string         `yaml:"source,omitempty" json:"source,omitempty"`
+	Dest     string         `yaml:"dest,omitempty" json:"dest,omitempty"`
+	Version  string         `yaml:"version,omitempty" json:"version,omitempty"`   // Version of the binary, if known
+	Checksum string         `yaml:"checksum,omitempty" json:"checksum,omitempty"` // Pinned sha256 of the download
+	Stages   []schema.Stage `yaml:"stages,omitempty" json:"stages,omitempty"`     // Stages run by extension actions
+	apply    func(l logger.KairosLogger) error
+}
+
+// Apply runs the action against the system
+func (a Action) Apply(l logger.KairosLogger) error {
+	if a.apply == nil {
+		return nil
+	}
+	return a.apply(l)
+}
+
+// applyActions applies the actions in order, stopping on the first error
+func applyActions(actions []Action, l logger.KairosLogger) error {
+	for _, a := range actions {
+		l.Logger.Debug().Str("step", a.Step).Str("kind", string(a.Kind)).Str("source", a.Source).Str("dest", a.Dest).Msg("Applying action")
+		if err := a.Apply(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embeddedSource is how embedded content is referred to in an Action source
+func embeddedSource(name string) string {
+	return "embedded:" + name
+}
+
+// extensionAction returns the action that runs the stages of the extension hook
+// It's used for the hooks of steps that only have actions, as yip stages always run before the actions
+func extensionAction(step, hook string, stages []schema.Stage) Action {
+	return Action{
+		Step:   step,
+		Kind:   ActionExtension,
+		Source: hook,
+		Stages: stages,
+		apply: func(l logger.KairosLogger) error {
+			yipConfig := schema.YipConfig{Stages: map[string][]schema.Stage{hook: stages}}
+			return newExecutor(l).Run(hook, config.RootFS(), newConsole(l), yipConfig.ToString())
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/kairos-io/kairos-init/pkg/bundled"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/constants"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+// Capability is something a step leaves in the system that other steps depend on
+type Capability string
+
+const (
+	CapKernelPackages   Capability = "kernel-packages"   // A kernel installed under /lib/modules
+	CapBootKernel       Capability = "boot-kernel"       // The kernel linked as /boot/vmlinuz
+	CapKairosBinaries   Capability = "kairos-binaries"   // kairos-agent and immucore
+	CapInitramfsConfigs Capability = "initramfs-configs" // The kairos dracut/mkinitfs configs and modules
+)
+
+// capabilityInfo describes a capability and how to tell if the system already has it
+type capabilityInfo struct {
+	description string
+	present     func(l logger.KairosLogger) bool // nil if it can't be checked
+}
+
+var capabilities = map[Capability]capabilityInfo{
+	CapKernelPackages: {
+		description: "a kernel installed under /lib/modules",
+		present: func(_ logger.KairosLogger) bool {
+			dirs, err := os.ReadDir(config.RootPath("/lib/modules"))
+			return err == nil && len(dirs) > 0
+		},
+	},
+	CapBootKernel: {
+		description: "the kernel linked as /boot/vmlinuz",
+		present:     func(_ logger.KairosLogger) bool { return exists("/boot/vmlinuz") },
+	},
+	CapKairosBinaries: {
+		description: "the kairos-agent and immucore binaries",
+		present: func(_ logger.KairosLogger) bool {
+			return exists(constants.AgentDefaultPath) && exists("/usr/bin/immucore")
+		},
+	},
+	CapInitramfsConfigs: {
+		description: "the kairos initramfs configs and modules",
+		present: func(_ logger.KairosLogger) bool {
+			// Trusted boot images don't build an initrd with them, so there is nothing to provide
+			if config.DefaultConfig.TrustedBoot {
+				return true
+			}
+			// The immucore module, either the dracut one or the mkinitfs one on Alpine
+			dracut := exists(bundled.DracutConfigPath) && exists(bundled.DracutImmucoreModuleSetupPath)
+			return dracut || exists("/etc/mkinitfs/features.d/immucore.files")
+		},
+	},
+}
+
+// exists returns true if the path exists in the target system
+func exists(path string) bool {
+	_, err := os.Lstat(config.RootPath(path))
+	return err == nil
+}
+
+// ValidateSkipSteps checks that the steps that are going to run in the given stage, init, install or all, have what
+// they need. A missing requirement is an error and a missing want is a warning, unless it's already in the system.
+// What the steps of the stages that don't run provide has to be in the system already, from a previous run.
+func ValidateSkipSteps(stage string, l logger.KairosLogger) error {
+	var multi *multierror.Error
+	for _, s := range registry {
+		if !runs(s, stage) {
+			continue
+		}
+		for _, c := range s.Requires() {
+			if reason, ok := checkCapability(c, stage, l); !ok {
+				multi = multierror.Append(multi, fmt.Errorf("step %s requires %s, %s. Skip %s as well or stop skipping the steps that provide it", s.Name(), capabilities[c].description, reason, s.Name()))
+			}
+		}
+		for _, c := range s.Wants() {
+			if reason, ok := checkCapability(c, stage, l); !ok {
+				l.Logger.Warn().Str("step", s.Name()).Str("wants", string(c)).Msgf("Step %s uses %s, %s. The result may not work as expected", s.Name(), capabilities[c].description, reason)
+			}
+		}
+	}
+	return multi.ErrorOrNil()
+}
+
+// checkCapability checks if the capability is provided by a step that runs in the stage or by the system
+// When it's not, the reason is returned
+func checkCapability(c Capability, stage string, l logger.KairosLogger) (string, bool) {
+	var skipped, notRun []string
+	for _, s := range registry {
+		for _, provided := range s.Provides() {
+			if provided != c {
+				continue
+			}
+			switch {
+			case runs(s, stage):
+				return "", true
+			case isSkipped(s):
+				skipped = append(skipped, s.Name())
+			default:
+				notRun = append(notRun, s.Name())
+			}
+		}
+	}
+
+	info := capabilities[c]
+	if info.present != nil && info.present(l) {
+		l.Logger.Debug().Str("capability", string(c)).Strs("skipped", skipped).Msg("Capability provided by the system")
+		return "", true
+	}
+
+	reason := "not found in the system"
+	if info.present == nil {
+		reason = "that can't be detected in the system"
+	}
+	if len(skipped) > 0 {
+		reason = fmt.Sprintf("%s and only provided by the skipped %s step", reason, strings.Join(skipped, ", "))
+	} else if len(notRun) > 0 {
+		reason = fmt.Sprintf("%s and only provided by the %s step of a stage that isn't run", reason, strings.Join(notRun, ", "))
+	}
+	return reason, false
+}
+
+// isSkipped returns true if the step or its whole stage is skipped
+func isSkipped(s Step) bool {
+	return config.ContainsSkipStep(s.Name()) || config.ContainsSkipStep(s.Stage())
+}
+
+// runs returns true if the step runs in the given stage, init, install or all (or empty), and is not skipped
+func runs(s Step, stage string) bool {
+	return !isSkipped(s) && (stage == "" || stage == "all" || stage == s.Stage())
+}
@@ -0,0 +1,524 @@
+package stages
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// checksumsFile is the name of the file with the sha256 of the release assets, next to them in the release
+// Its signature, if the releases are signed, is the same file with the .sig extension
+const checksumsFile = "checksums.txt"
+
+// DownloadAndExtract downloads a binary, or an archive with it, from the given URL, verifies it and writes the binary
+// to the destination path. Archives can be tar, optionally compressed with gzip, xz or zstd, or zip.
+// The download is checked against the given sha256, or the one in the checksums file of the release if empty. With a
+// public key in the version overrides, the checksums file has to be signed with it. Nothing is written if any of the
+// checks fail. With a download cache, a verified download is only downloaded once, but the checksums file and its
+// signature are always downloaded, so only downloads with a pinned sha256 can be done without network.
+// If a binary name is provided as an optional parameter, it uses that name, or path in the archive if it has a /, to
+// locate the binary in the archive, with the other ones as alternative names; otherwise, it defaults to using the base
+// name of the destination path. The function returns an error if the download, verification, extraction, or file
+// operations fail, if it's neither a supported archive nor an ELF binary, or if the binary is not found in the archive
+// or more than one entry matches it.
+func DownloadAndExtract(url, dest, checksum string, l logger.KairosLogger, binaryName ...string) error {
+	var err error
+	if checksum == "" {
+		if checksum, err = releaseChecksum(url); err != nil {
+			return err
+		}
+	}
+	data, err := cachedFetch(url, checksum, l)
+	if err != nil {
+		return err
+	}
+	if err = verifyChecksum(data, checksum); err != nil {
+		return fmt.Errorf("failed to verify %s: %w", url, err)
+	}
+	return installBinary(data, dest, binaryName...)
+}
+
+// CopyLocalBinary writes a local binary to the destination path, like DownloadAndExtract does with a download.
+// The source can be the binary itself, an archive with it or a directory with it. It's checked against the given
+// sha256 if any, as there is no release to get it from.
+func CopyLocalBinary(src, dest, checksum string, binaryName ...string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to read local binary: %w", err)
+	}
+	if info.IsDir() {
+		dir := src
+		for _, target := range targetBinaries(dest, binaryName...) {
+			if src = filepath.Join(dir, target); fileExists(src) {
+				break
+			}
+		}
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read local binary: %w", err)
+	}
+	if checksum != "" {
+		if err = verifyChecksum(data, checksum); err != nil {
+			return fmt.Errorf("failed to verify %s: %w", src, err)
+		}
+	}
+	return installBinary(data, dest, binaryName...)
+}
+
+// fileExists returns whether the path exists in the running system
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// targetBinaries returns the names of the binary to look for, the given ones or the base name of the destination path
+func targetBinaries(dest string, binaryName ...string) []string {
+	if len(binaryName) > 0 {
+		return binaryName
+	}
+	return []string{filepath.Base(dest)}
+}
+
+// installBinary writes the binary in data to dest, extracting it first if data is an archive
+func installBinary(data []byte, dest string, binaryName ...string) error {
+	binary, err := binaryInArchive(data, targetBinaries(dest, binaryName...))
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(dest, binary, 0755); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	// WriteFile keeps the permissions of an existing file
+	if err = os.Chmod(dest, 0755); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	return nil
+}
+
+// The magic numbers of the supported compression and archive formats
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte{'P', 'K', 0x03, 0x04}
+	elfMagic  = []byte{0x7f, 'E', 'L', 'F'}
+)
+
+// binaryInArchive returns the binary in a tar, optionally compressed with gzip, xz or zstd, or zip archive, or data
+// itself if it's a raw ELF binary. A compressed raw binary is decompressed. Anything else is an error, so an error page
+// or an archive in an unsupported format is never installed as the binary.
+// The targets are the names of the binary or its path in the archive if they have a /. Archives with entries outside
+// of them, or with more than one entry matching the targets, are rejected.
+func binaryInArchive(data []byte, targets []string) ([]byte, error) {
+	var decompressor io.Reader
+	var err error
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		decompressor, err = gzip.NewReader(bytes.NewReader(data))
+	case bytes.HasPrefix(data, xzMagic):
+		decompressor, err = xz.NewReader(bytes.NewReader(data))
+	case bytes.HasPrefix(data, zstdMagic):
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(bytes.NewReader(data)); err == nil {
+			defer zr.Close()
+			decompressor = zr
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the decompressor: %w", err)
+	}
+	if decompressor != nil {
+		if data, err = io.ReadAll(decompressor); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+
+	var found []string
+	var binary []byte
+	match := func(name string, open func() ([]byte, error)) error {
+		ok, err := matchEntry(name, targets)
+		if err != nil || !ok {
+			return err
+		}
+		found = append(found, name)
+		binary, err = open()
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, zipMagic):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zip file: %w", err)
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				if _, err = matchEntry(f.Name, targets); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			err = match(f.Name, func() ([]byte, error) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(rc)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to read zip file: %w", err)
+			}
+		}
+	case isTar(data):
+		tarReader := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read tar file: %w", err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				if _, err = matchEntry(header.Name, targets); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err = match(header.Name, func() ([]byte, error) { return io.ReadAll(tarReader) }); err != nil {
+				return nil, fmt.Errorf("failed to read tar file: %w", err)
+			}
+		}
+	case bytes.HasPrefix(data, elfMagic):
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format, expected a tar or zip archive or an ELF binary")
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("binary %s not found in archive", strings.Join(targets, " or "))
+	case 1:
+		return binary, nil
+	default:
+		return nil, fmt.Errorf("more than one %s in archive (%s), set its path in the archive", strings.Join(targets, " or "), strings.Join(found, ", "))
+	}
+}
+
+// isTar returns whether data is a tar archive, from the ustar magic of its first header
+func isTar(data []byte) bool {
+	return len(data) >= 262 && bytes.Equal(data[257:262], []byte("ustar"))
+}
+
+// matchEntry returns whether the archive entry is one of the targets, matching its whole path if the target has a /
+// and its basename otherwise. Entries outside of the archive are an error.
+func matchEntry(name string, targets []string) (bool, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return false, fmt.Errorf("invalid archive, entry %s is outside of it", name)
+	}
+	for _, target := range targets {
+		if strings.Contains(target, "/") {
+			if clean == path.Clean(strings.TrimPrefix(target, "./")) {
+				return true, nil
+			}
+		} else if path.Base(clean) == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseURL returns the url to download the release version of the binary from, the one of its url template if
+// there is one or the one of the GitHub release otherwise
+// edgevpn names its releases with the arch alias, x86_64 instead of amd64.
+func releaseURL(binary string, vars config.ReleaseURLVars, l logger.KairosLogger) string {
+	url, ok, err := config.DefaultConfig.VersionOverrides.ReleaseURL(binary, vars)
+	if err != nil {
+		// The templates are validated with the config, so this won't happen outside of tests
+		l.Logger.Error().Err(err).Str("binary", binary).Msg("Failed to render the url template")
+	}
+	if ok {
+		return url
+	}
+	arch := vars.Arch
+	if binary == config.EdgeVpnBinary {
+		arch = vars.ArchAlias
+	}
+	return fmt.Sprintf("https://github.com/%[4]s/%[1]s/releases/download/%[2]s/%[1]s-%[2]s-Linux-%[3]s%[5]s.tar.gz", vars.Repo, vars.Version, arch, vars.Org, vars.Fips)
+}
+
+// archAlias returns the other name of the arch used by some releases, x86_64 for amd64
+func archAlias(arch values.Architecture) string {
+	if arch == values.ArchAMD64 {
+		return "x86_64"
+	}
+	return arch.String()
+}
+
+// overrideURL returns the url of a version override that is a url instead of a version
+func overrideURL(override string) (string, bool) {
+	if strings.HasPrefix(override, "http://") || strings.HasPrefix(override, "https://") {
+		return override, true
+	}
+	return "", false
+}
+
+// overridePath returns the local path of a version override that is a file:// url or an absolute path
+// It's a path in the system kairos-init runs in, not under the root it works on
+func overridePath(override string) (string, bool) {
+	if p, ok := strings.CutPrefix(override, "file://"); ok {
+		return p, true
+	}
+	if filepath.IsAbs(override) {
+		return override, true
+	}
+	return "", false
+}
+
+// overrideVersion returns the version override if it's a release version, and empty if it's a url or a local path
+func overrideVersion(override string) string {
+	if _, ok := overrideURL(override); ok {
+		return ""
+	}
+	if _, ok := overridePath(override); ok {
+		return ""
+	}
+	return override
+}
+
+// retryBackoff is the wait before the first retry of a download, doubled on each retry
+var retryBackoff = time.Second
+
+// fetch downloads the url, anything but a 200 response is an error
+// Network errors and 429 or 5xx responses are retried as many times as configured.
+func fetch(url string) ([]byte, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		data, retry, err := fetchOnce(client, url)
+		if err == nil {
+			return data, nil
+		}
+		if !retry || attempt >= config.DefaultConfig.Downloads.Retries {
+			if attempt > 0 {
+				return nil, fmt.Errorf("%w (after %d attempts)", err, attempt+1)
+			}
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchOnce downloads the url, returning whether the failure is worth retrying
+func fetchOnce(client *http.Client, url string) ([]byte, bool, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return nil, retry, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return data, false, nil
+}
+
+// httpClient returns the client for the downloads, with the configured timeout and CA bundle
+// The proxy is set explicitly from HTTP_PROXY, HTTPS_PROXY and NO_PROXY, as CI runners behind a proxy rely on them.
+func httpClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if bundle := config.DefaultConfig.Downloads.CABundle; bundle != "" {
+		certs, err := os.ReadFile(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(certs) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle %s", bundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: config.DefaultConfig.Downloads.Timeout}, nil
+}
+
+// cachedFetch returns the download at url from the cache dir, if there is one, downloading it into the cache if it's
+// not there yet
+// The cache is keyed by the url and the checksum, and only downloads that match the checksum are kept in it. Failing
+// to write to the cache doesn't fail the download, it's just downloaded again the next time.
+func cachedFetch(url, checksum string, l logger.KairosLogger) ([]byte, error) {
+	dir := config.DefaultConfig.Downloads.CacheDir
+	if dir == "" {
+		return fetch(url)
+	}
+	key := sha256.Sum256([]byte(url + "\n" + strings.ToLower(checksum)))
+	cached := filepath.Join(dir, hex.EncodeToString(key[:]))
+	if data, err := os.ReadFile(cached); err == nil && verifyChecksum(data, checksum) == nil {
+		return data, nil
+	}
+
+	data, err := fetch(url)
+	if err != nil || verifyChecksum(data, checksum) != nil {
+		return data, err
+	}
+	if err = writeCache(dir, cached, data); err != nil {
+		l.Logger.Warn().Err(err).Str("url", url).Str("cache", dir).Msg("Failed to write the download cache")
+	}
+	return data, nil
+}
+
+// writeCache writes data to the cached path of the cache dir
+// It's written to a temporary file first so builds sharing the cache never read a partial download.
+func writeCache(dir, cached string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create the download cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return fmt.Errorf("failed to write the download cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the download cache: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write the download cache: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), cached); err != nil {
+		return fmt.Errorf("failed to write the download cache: %w", err)
+	}
+	return nil
+}
+
+// releaseChecksum returns the sha256 of the asset at url from the checksums file of its release, verifying the
+// signature of the checksums file first if there is a public key
+func releaseChecksum(url string) (string, error) {
+	checksumsURL := url[:strings.LastIndex(url, "/")+1] + checksumsFile
+	checksums, err := fetch(checksumsURL)
+	if err != nil {
+		return "", fmt.Errorf("no checksum to verify %s, pin one in the version overrides: %w", url, err)
+	}
+	if keyFile := config.DefaultConfig.VersionOverrides.PublicKey; keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the public key: %w", err)
+		}
+		signature, err := fetch(checksumsURL + ".sig")
+		if err != nil {
+			return "", fmt.Errorf("no signature to verify %s: %w", checksumsURL, err)
+		}
+		if err = verifySignature(checksums, signature, key); err != nil {
+			return "", fmt.Errorf("failed to verify the signature of %s: %w", checksumsURL, err)
+		}
+	}
+
+	name := path.Base(url)
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		// sha256sum format, the file name can be prefixed with * for binary mode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in %s, pin one in the version overrides", name, checksumsURL)
+}
+
+// verifyChecksum checks the sha256 of data
+func verifyChecksum(data []byte, checksum string) error {
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, checksum) {
+		return fmt.Errorf("checksum mismatch, expected sha256 %s but got %s", checksum, got)
+	}
+	return nil
+}
+
+// verifySignature checks the detached signature of data with the public key, either a GPG one or a PEM one as used
+// by cosign, with its signature in base64
+func verifySignature(data, signature, key []byte) error {
+	if bytes.Contains(key, []byte("BEGIN PGP PUBLIC KEY BLOCK")) {
+		keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		if err != nil {
+			return fmt.Errorf("invalid GPG public key: %w", err)
+		}
+		if bytes.Contains(signature, []byte("BEGIN PGP SIGNATURE")) {
+			_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil)
+		} else {
+			_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil)
+		}
+		return err
+	}
+
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("invalid public key, expected a PEM or an armored GPG key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		sig = signature
+	}
+	digest := sha256.Sum256(data)
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
@@ -0,0 +1,422 @@
+package stages
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var testLog = logger.NewKairosLogger("test", "error", false)
+
+// tarGz returns a tar.gz archive with a single file
+func tarGz(t *testing.T, name, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	if _, err := gzw.Write(tarArchive(t, name, content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarArchive returns a tar archive with the files, given as pairs of name and content, the names ending in / are dirs
+func tarArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		header := &tar.Header{Name: files[i], Mode: 0755, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(files[i], "/") {
+			header.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipArchive returns a zip archive with the files, given as pairs of name and content
+func zipArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// compress returns data compressed with gzip, xz or zstd
+func compress(t *testing.T, format string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloadAndExtractVerification(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+
+	archive := tarGz(t, "immucore", "binary")
+	files := map[string][]byte{
+		"/v1/immucore.tar.gz": archive,
+		"/v1/checksums.txt":   []byte(fmt.Sprintf("0000  other.tar.gz\n%s *immucore.tar.gz\n", sha256Hex(archive))),
+		"/v2/immucore.tar.gz": archive,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	dest := filepath.Join(t.TempDir(), "immucore")
+
+	if err := DownloadAndExtract(server.URL+"/v1/missing.tar.gz", dest, sha256Hex(archive), testLog); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected an error for a missing download, got %v", err)
+	}
+	if err := DownloadAndExtract(server.URL+"/v1/immucore.tar.gz", dest, sha256Hex([]byte("other")), testLog); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if err := DownloadAndExtract(server.URL+"/v1/missing.tar.gz", dest, "", testLog); err == nil || !strings.Contains(err.Error(), "no checksum for missing.tar.gz") {
+		t.Errorf("expected an error without a checksum for the download, got %v", err)
+	}
+	if err := DownloadAndExtract(server.URL+"/v2/immucore.tar.gz", dest, "", testLog); err == nil || !strings.Contains(err.Error(), "pin one") {
+		t.Errorf("expected an error without a checksums file, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written when the verification fails, got %v", err)
+	}
+
+	if err := DownloadAndExtract(server.URL+"/v1/immucore.tar.gz", dest, "", testLog); err != nil {
+		t.Fatalf("expected the checksums file to verify the download, got %v", err)
+	}
+	if got := readFile(t, dest); got != "binary" {
+		t.Errorf("unexpected binary content %q", got)
+	}
+	if err := DownloadAndExtract(server.URL+"/v2/immucore.tar.gz", dest, strings.ToUpper(sha256Hex(archive)), testLog); err != nil {
+		t.Errorf("expected the pinned checksum to verify the download, got %v", err)
+	}
+
+	// With a public key, the checksums file has to be signed
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultConfig.VersionOverrides.PublicKey = keyFile
+
+	if err = DownloadAndExtract(server.URL+"/v1/immucore.tar.gz", dest, "", testLog); err == nil || !strings.Contains(err.Error(), "no signature") {
+		t.Errorf("expected an error without a signature, got %v", err)
+	}
+	files["/v1/checksums.txt.sig"] = []byte(base64.StdEncoding.EncodeToString([]byte("not a signature")))
+	if err = DownloadAndExtract(server.URL+"/v1/immucore.tar.gz", dest, "", testLog); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("expected an invalid signature, got %v", err)
+	}
+	digest := sha256.Sum256(files["/v1/checksums.txt"])
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/v1/checksums.txt.sig"] = []byte(base64.StdEncoding.EncodeToString(sig))
+	if err = DownloadAndExtract(server.URL+"/v1/immucore.tar.gz", dest, "", testLog); err != nil {
+		t.Errorf("expected the signed checksums file to verify the download, got %v", err)
+	}
+}
+
+func TestCopyLocalBinary(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "kairos-agent"), []byte("\x7fELF binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "agent.tar.gz"), tarGz(t, "bin/kairos-agent", "archived"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "kairos-agent")
+
+	for source, expected := range map[string]string{
+		filepath.Join(src, "kairos-agent"): "\x7fELF binary",
+		src:                                "\x7fELF binary",
+		filepath.Join(src, "agent.tar.gz"): "archived",
+	} {
+		if err := CopyLocalBinary(source, dest, ""); err != nil {
+			t.Fatalf("CopyLocalBinary(%s): %v", source, err)
+		}
+		if got := readFile(t, dest); got != expected {
+			t.Errorf("expected %q from %s, got %q", expected, source, got)
+		}
+		info, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0755 {
+			t.Errorf("expected the binary from %s to be executable, got %s", source, info.Mode())
+		}
+	}
+
+	if err := CopyLocalBinary(src, dest, sha256Hex([]byte("other"))); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if err := CopyLocalBinary(filepath.Join(src, "missing"), dest, ""); err == nil {
+		t.Errorf("expected an error for a missing binary")
+	}
+}
+
+func TestOverrideVersion(t *testing.T) {
+	for override, expected := range map[string]string{
+		"v2.20.0":                    "v2.20.0",
+		"https://example.com/agent":  "",
+		"file:///build/kairos-agent": "",
+		"/build/kairos-agent.tar.gz": "",
+	} {
+		if got := overrideVersion(override); got != expected {
+			t.Errorf("overrideVersion(%s) = %q, expected %q", override, got, expected)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	prev, prevBackoff := config.DefaultConfig, retryBackoff
+	t.Cleanup(func() { config.DefaultConfig, retryBackoff = prev, prevBackoff })
+	retryBackoff = time.Millisecond
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case requests < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("data"))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	config.DefaultConfig.Downloads.Retries = 1
+	if _, err := fetch(server.URL + "/flaky"); err == nil || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("expected the download to fail after the retries, got %v", err)
+	}
+	requests = 0
+	config.DefaultConfig.Downloads.Retries = 2
+	if data, err := fetch(server.URL + "/flaky"); err != nil || string(data) != "data" {
+		t.Errorf("expected the download to succeed on a retry, got %q, %v", data, err)
+	}
+
+	requests = 0
+	if _, err := fetch(server.URL + "/missing"); err == nil || requests != 1 {
+		t.Errorf("expected a 404 not to be retried, got %d requests, %v", requests, err)
+	}
+
+	config.DefaultConfig.Downloads.Retries = 0
+	config.DefaultConfig.Downloads.Timeout = 50 * time.Millisecond
+	if _, err := fetch(server.URL + "/slow"); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("expected the download to time out, got %v", err)
+	}
+}
+
+func TestFetchCABundle(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Downloads.Retries = 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("data"))
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := fetch(server.URL); err == nil {
+		t.Fatalf("expected the self-signed certificate to be rejected")
+	}
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultConfig.Downloads.CABundle = bundle
+	if data, err := fetch(server.URL); err != nil || string(data) != "data" {
+		t.Errorf("expected the CA bundle to be trusted, got %q, %v", data, err)
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Downloads.CacheDir = filepath.Join(t.TempDir(), "cache")
+
+	archive := tarGz(t, "edgevpn", "binary")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(archive)
+	}))
+	t.Cleanup(server.Close)
+	dest := filepath.Join(t.TempDir(), "edgevpn")
+
+	for range 2 {
+		if err := DownloadAndExtract(server.URL+"/edgevpn.tar.gz", dest, sha256Hex(archive), testLog); err != nil {
+			t.Fatalf("DownloadAndExtract: %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the second download to come from the cache, got %d requests", requests)
+	}
+	entries, err := os.ReadDir(config.DefaultConfig.Downloads.CacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected a single cached download, got %v, %v", entries, err)
+	}
+
+	// A corrupted cache entry is downloaded again, and a download that doesn't match isn't cached
+	if err = os.WriteFile(filepath.Join(config.DefaultConfig.Downloads.CacheDir, entries[0].Name()), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = DownloadAndExtract(server.URL+"/edgevpn.tar.gz", dest, sha256Hex(archive), testLog); err != nil || requests != 2 {
+		t.Errorf("expected the corrupted entry to be downloaded again, got %d requests, %v", requests, err)
+	}
+	if err = DownloadAndExtract(server.URL+"/edgevpn.tar.gz", dest, sha256Hex([]byte("other")), testLog); err == nil {
+		t.Errorf("expected a checksum mismatch")
+	}
+	if entries, _ = os.ReadDir(config.DefaultConfig.Downloads.CacheDir); len(entries) != 1 {
+		t.Errorf("expected only the verified download in the cache, got %v", entries)
+	}
+
+	// A cache that can't be written to doesn't fail the download
+	file := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultConfig.Downloads.CacheDir = filepath.Join(file, "cache")
+	if err = DownloadAndExtract(server.URL+"/edgevpn.tar.gz", dest, sha256Hex(archive), testLog); err != nil {
+		t.Errorf("expected the download to work without the cache, got %v", err)
+	}
+}
+
+func TestBinaryInArchive(t *testing.T) {
+	files := []string{"foo-kairos-agent", "decoy", "dist/", "", "dist/kairos-agent", "binary", "README.md", "readme"}
+	tarball := tarArchive(t, files...)
+	for name, archive := range map[string][]byte{
+		"tar":     tarball,
+		"tar.gz":  compress(t, "gzip", tarball),
+		"tar.xz":  compress(t, "xz", tarball),
+		"tar.zst": compress(t, "zstd", tarball),
+		"zip":     zipArchive(t, files...),
+	} {
+		got, err := binaryInArchive(archive, []string{"kairos-agent"})
+		if err != nil || string(got) != "binary" {
+			t.Errorf("expected the exact match from the %s archive, got %q, %v", name, got, err)
+		}
+	}
+
+	elf := []byte("\x7fELF binary")
+	for name, data := range map[string][]byte{"raw": elf, "gzip": compress(t, "gzip", elf), "zstd": compress(t, "zstd", elf)} {
+		if got, err := binaryInArchive(data, []string{"kairos-agent"}); err != nil || !bytes.Equal(got, elf) {
+			t.Errorf("expected the %s binary as is, got %q, %v", name, got, err)
+		}
+	}
+
+	for name, data := range map[string][]byte{"html": []byte("<html>Not Found</html>"), "gzip": compress(t, "gzip", []byte("#!/bin/sh"))} {
+		if _, err := binaryInArchive(data, []string{"kairos-agent"}); err == nil || !strings.Contains(err.Error(), "unsupported archive format") {
+			t.Errorf("expected the %s data that is neither an archive nor an ELF binary to be rejected, got %v", name, err)
+		}
+	}
+
+	for name, archive := range map[string][]byte{
+		"tar": tarArchive(t, "kairos-agent", "binary", "../../etc/cron.d/evil", "evil"),
+		"zip": zipArchive(t, "kairos-agent", "binary", "/etc/cron.d/evil", "evil"),
+	} {
+		if _, err := binaryInArchive(archive, []string{"kairos-agent"}); err == nil || !strings.Contains(err.Error(), "outside of it") {
+			t.Errorf("expected the %s archive with a path traversal to be rejected, got %v", name, err)
+		}
+	}
+
+	multiple := tarArchive(t, "amd64/kairos-agent", "amd64", "arm64/kairos-agent", "arm64")
+	if _, err := binaryInArchive(multiple, []string{"kairos-agent"}); err == nil || !strings.Contains(err.Error(), "more than one") {
+		t.Errorf("expected an error for more than one candidate, got %v", err)
+	}
+	if got, err := binaryInArchive(multiple, []string{"./arm64/kairos-agent"}); err != nil || string(got) != "arm64" {
+		t.Errorf("expected the binary at the path, got %q, %v", got, err)
+	}
+	if _, err := binaryInArchive(tarArchive(t, "foo-kairos-agent", "decoy"), []string{"kairos-agent"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected no match for a name that only ends with the binary name, got %v", err)
+	}
+	if got, err := binaryInArchive(tarArchive(t, "provider-kairos", "provider"), []string{"agent-provider-kairos", "provider-kairos"}); err != nil || string(got) != "provider" {
+		t.Errorf("expected the alternative name to match, got %q, %v", got, err)
+	}
+}
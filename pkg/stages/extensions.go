@@ -1,61 +1,360 @@
 package stages
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types/logger"
 	"github.com/mudler/yip/pkg/schema"
-	"github.com/sanity-io/litter"
-	"github.com/twpayne/go-vfs/v5"
+	cloudinit "github.com/mudler/yip/pkg/schema/cloudinit"
+	"gopkg.in/yaml.v3"
 )
 
-// GetStageExtensions returns the expansions for a given stage
-// It loads the extensions from a dir in the filesystem, loads all files and only selects the proper stage to be returned
-func GetStageExtensions(stage string, logger logger.KairosLogger) []schema.Stage {
-	var data []schema.Stage
-	// If extensions are not enabled, return empty
+// Extensions are the stages loaded from the extensions dir by the stage or step hook they run in
+type Extensions map[string][]schema.Stage
+
+// DefaultExtensionsDir is where the extensions are loaded from if no dir is configured
+const DefaultExtensionsDir = "/etc/kairos-init/stage-extensions"
+
+// GetExtensions loads the extensions from the configured dirs for the given system, nothing if extensions are not
+// enabled. Any problem in the extensions fails, unless they are loaded leniently, then the problems are logged and
+// the files or stages with problems are ignored
+func GetExtensions(sis values.System, logger logger.KairosLogger) (Extensions, error) {
 	if !config.DefaultConfig.Extensions {
-		return data
+		return Extensions{}, nil
 	}
 
-	dir := os.Getenv("KAIROS_INIT_STAGE_EXTENSIONS_DIR")
-	if dir == "" {
-		dir = "/etc/kairos-init/stage-extensions"
+	sources := []string(config.DefaultConfig.ExtensionsDirs)
+	if len(sources) == 0 {
+		// Only the dirs set by the user have to exist, no default dir just means no extensions
+		if _, err := os.Stat(DefaultExtensionsDir); os.IsNotExist(err) {
+			logger.Logger.Debug().Str("dir", DefaultExtensionsDir).Msg("No stage extensions dir, not loading extensions")
+			return Extensions{}, nil
+		}
+		sources = []string{DefaultExtensionsDir}
 	}
 
-	logger.Logger.Debug().Str("stage", stage).Str("dir", dir).Msg("getting stage")
+	ext, err := LoadExtensions(sources, ExtensionTemplateParams(sis, logger), logger)
+	if err != nil {
+		if !config.DefaultConfig.ExtensionsLenient {
+			logger.Logger.Error().Strs("sources", sources).Err(err).Msg("Invalid stage extensions")
+			return ext, fmt.Errorf("invalid stage extensions: %w", err)
+		}
+		logger.Logger.Warn().Strs("sources", sources).Err(err).Msg("Ignoring the invalid stage extensions")
+	}
+	return ext, nil
+}
+
+// LoadExtensions renders the yaml files of the given sources with the params and loads them
+// Sources are dirs or .tar.gz bundles, loaded in the given order, and the files of each one are loaded in lexical
+// order. A stage with the same name as one of a previous source in the same hook replaces it, so later sources can
+// override earlier ones.
+// All the files are checked, and every problem found is returned at once along with the stages that could be loaded:
+// files that can't be rendered or parsed or have unknown keys, stages that are not a known stage or step hook and
+// stages with the same name in the same hook of a source.
+func LoadExtensions(sources []string, params map[string]string, logger logger.KairosLogger) (Extensions, error) {
+	ext := Extensions{}
+	var multi *multierror.Error
+	known := map[string]bool{}
+	for _, hook := range ExtensionHooks() {
+		known[hook] = true
+	}
 
-	// Go over all the files in order
-	// and load them
-	litter.Config.HideZeroValues = true
-	litter.Config.HidePrivateFields = false
-	_ = vfs.Walk(vfs.OSFS, dir, func(path string, info os.FileInfo, err error) error {
+	for _, source := range sources {
+		files, err := readExtensionSource(source, logger)
 		if err != nil {
-			return err
+			multi = multierror.Append(multi, fmt.Errorf("reading %s: %w", source, err))
+			continue
 		}
+		// Where each stage name was defined in this source, by hook
+		defined := map[string]map[string]string{}
+		for _, f := range files {
+			logger.Logger.Debug().Str("file", f.path).Msg("loading file")
+			yipConfig, err := loadExtensionFile(f, params, logger)
+			if err != nil {
+				multi = multierror.Append(multi, fmt.Errorf("%s: %w", f.path, err))
+				continue
+			}
 
-		if info.IsDir() {
+			hooks := make([]string, 0, len(yipConfig.Stages))
+			for hook := range yipConfig.Stages {
+				hooks = append(hooks, hook)
+			}
+			sort.Strings(hooks)
+			for _, hook := range hooks {
+				if !known[hook] {
+					multi = multierror.Append(multi, fmt.Errorf("%s: unknown stage %q, run steps-info to see the stages that can be extended", f.path, hook))
+					continue
+				}
+				if defined[hook] == nil {
+					defined[hook] = map[string]string{}
+				}
+				for _, st := range yipConfig.Stages[hook] {
+					if previous, ok := defined[hook][st.Name]; ok && st.Name != "" {
+						multi = multierror.Append(multi, fmt.Errorf("%s: duplicate stage name %q in %s, already defined in %s", f.path, st.Name, hook, previous))
+						continue
+					}
+					defined[hook][st.Name] = f.path
+					if i := slices.IndexFunc(ext[hook], func(s schema.Stage) bool { return s.Name == st.Name }); i >= 0 && st.Name != "" {
+						logger.Logger.Debug().Str("file", f.path).Str("stage", hook).Str("name", st.Name).Msg("overriding stage from a previous source")
+						ext[hook][i] = st
+						continue
+					}
+					logger.Logger.Debug().Str("file", f.path).Str("stage", hook).Msg("found stage, appending data")
+					ext[hook] = append(ext[hook], st)
+				}
+			}
+		}
+	}
+	return ext, multi.ErrorOrNil()
+}
+
+// extensionFile is an extension file read from a source
+type extensionFile struct {
+	path string
+	data []byte
+}
+
+// isExtensionFile returns true if the file should be loaded as an extension
+func isExtensionFile(name string) bool {
+	return filepath.Ext(name) == ".yaml" || filepath.Ext(name) == ".yml"
+}
+
+// isExtensionBundle returns true if the source is a bundle instead of a dir
+func isExtensionBundle(source string) bool {
+	return strings.HasSuffix(source, ".tar.gz") || strings.HasSuffix(source, ".tgz")
+}
+
+// readExtensionSource reads the extension files of a dir or a bundle, in lexical order
+func readExtensionSource(source string, logger logger.KairosLogger) ([]extensionFile, error) {
+	if isExtensionBundle(source) {
+		return readExtensionBundle(source, logger)
+	}
+	var files []extensionFile
+	err := filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
 			return nil
 		}
-		if filepath.Ext(info.Name()) != ".yaml" && filepath.Ext(info.Name()) != ".yml" {
+		if !isExtensionFile(d.Name()) {
 			logger.Logger.Debug().Str("file", path).Msg("skipping file due to file extension")
 			return nil
 		}
-
-		logger.Logger.Debug().Str("file", path).Msg("loading file")
-		d, err := schema.Load(path, vfs.OSFS, schema.FromFile, nil)
+		data, err := os.ReadFile(path)
 		if err != nil {
-			logger.Logger.Error().Str("file", path).Err(err).Msg("error loading file")
-			return nil
-		}
-		for _, s := range d.Stages[stage] {
-			logger.Logger.Debug().Str("file", path).Msg("found stage, appending data")
-			data = append(data, s)
+			return err
 		}
+		files = append(files, extensionFile{path: path, data: data})
 		return nil
 	})
+	return files, err
+}
+
+// readExtensionBundle reads the extension files of a .tar.gz bundle, in lexical order of their path in the bundle
+// Files are read in memory, nothing is extracted to disk
+func readExtensionBundle(bundle string, logger logger.KairosLogger) ([]extensionFile, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var files []extensionFile
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid path %s in bundle", header.Name)
+		}
+		if !isExtensionFile(name) {
+			logger.Logger.Debug().Str("file", name).Str("bundle", bundle).Msg("skipping file due to file extension")
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, extensionFile{path: fmt.Sprintf("%s:%s", bundle, name), data: data})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+// isExtensionTemplate returns true if the extension file has to be rendered as a template before loading it
+// Only the .tmpl.yaml and .tmpl.yml files are, so a literal {{ in a plain file is kept as is
+func isExtensionTemplate(name string) bool {
+	return strings.HasSuffix(name, ".tmpl.yaml") || strings.HasSuffix(name, ".tmpl.yml")
+}
+
+// loadExtensionFile renders the extension file if it's a template and parses it, failing on keys that are not part of
+// the yip schema
+// Cloud-config files are still loaded as they were before, only their stages are used, but they are deprecated.
+func loadExtensionFile(f extensionFile, params map[string]string, logger logger.KairosLogger) (*schema.YipConfig, error) {
+	data := f.data
+	var err error
+	if isExtensionTemplate(f.path) {
+		if data, err = renderExtension(filepath.Base(f.path), f.data, params); err != nil {
+			return nil, err
+		}
+	} else if bytes.Contains(data, []byte("{{")) {
+		// Likely a template from before templating was opt-in, the {{ could also be meant for a command
+		logger.Logger.Warn().Str("file", f.path).Msg("Extension file has {{ but is not rendered as a template, rename it to .tmpl.yaml to render it")
+	}
+	// Same as yip, a file can only be empty or have stages
+	if strings.TrimSpace(string(data)) == "" {
+		return &schema.YipConfig{}, nil
+	}
+	yipConfig := &schema.YipConfig{}
+	// The cloud-config keys can't target the kairos-init stages and never did anything, so they are not checked
+	if cloudinit.IsCloudConfig(string(data)) {
+		logger.Logger.Warn().Str("file", f.path).Msg("Cloud-config extension files are deprecated and only their stages are loaded, remove the #cloud-config header and any other keys")
+		if err = yaml.Unmarshal(data, yipConfig); err != nil {
+			return nil, err
+		}
+		yipConfig.Source = f.path
+		return yipConfig, nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(yipConfig); err != nil {
+		return nil, err
+	}
+	yipConfig.Source = f.path
+	return yipConfig, nil
+}
+
+// renderExtension renders the extension as a go template with the given params
+// Using a param that doesn't exist is an error, so typos don't end up as empty values
+func renderExtension(name string, data []byte, params map[string]string) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var result bytes.Buffer
+	if err = tmpl.Execute(&result, params); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+// extensionParamKeys are the params that can be used in the extension templates
+var extensionParamKeys = []string{"distro", "family", "version", "arch", "model", "variant", "trusted_boot", "fips", "kairos_version", "kernel"}
+
+// ExtensionTemplateParams returns the params the extensions are rendered with: the ones from values.GetTemplateParams
+// plus the config and the kernel version. The kernel is empty until the kernel packages are installed.
+func ExtensionTemplateParams(sis values.System, logger logger.KairosLogger) map[string]string {
+	params := values.GetTemplateParams(sis)
+	params["model"] = config.DefaultConfig.Model
+	params["variant"] = config.DefaultConfig.Variant.String()
+	params["trusted_boot"] = strconv.FormatBool(config.DefaultConfig.TrustedBoot)
+	params["fips"] = strconv.FormatBool(config.DefaultConfig.Fips)
+	params["kairos_version"] = config.DefaultConfig.KairosVersion.Original()
+	params["kernel"] = ""
+	if capabilities[CapKernelPackages].present(logger) || config.DefaultConfig.DryRun {
+		if k, err := getLatestKernel(logger); err == nil {
+			params["kernel"] = k
+		}
+	}
+	return params
+}
 
+// ExtensionPlaceholderParams returns params with placeholders as values, to check the extensions without a system
+func ExtensionPlaceholderParams() map[string]string {
+	params := map[string]string{}
+	for _, k := range extensionParamKeys {
+		params[k] = fmt.Sprintf("<%s>", k)
+	}
+	return params
+}
+
+// ExtensionHooks returns all the stages that can be extended, in the order they run
+func ExtensionHooks() []string {
+	var hooks []string
+	for _, stage := range stageDescriptions {
+		hooks = append(hooks, stagePhases(stage.Key)...)
+		for _, s := range Steps(stage.Key) {
+			before, after := StepHooks(s.Name())
+			hooks = append(hooks, before, after)
+		}
+	}
+	return hooks
+}
+
+// StepHooks returns the extension stages that run right before and after the given step
+func StepHooks(step string) (before string, after string) {
+	return "before-" + step, "after-" + step
+}
+
+// addStepHooks adds the before-<step> and after-<step> extensions around what the step does
+// They go into the first and last phase the step uses, or around its actions if it only has actions. Steps that do
+// nothing still run their hooks in the main phase of their stage.
+func addStepHooks(s Step, data Plan, ext Extensions) Plan {
+	beforeName, afterName := StepHooks(s.Name())
+	before := slices.Clone(ext[beforeName])
+	after := slices.Clone(ext[afterName])
+	if len(before) == 0 && len(after) == 0 {
+		return data
+	}
+
+	var used []string
+	for _, phase := range stagePhases(s.Stage()) {
+		if len(data.Stages[phase]) > 0 {
+			used = append(used, phase)
+		}
+	}
+
+	switch {
+	case len(used) > 0:
+		data.Stages[used[0]] = append(before, data.Stages[used[0]]...)
+	case len(data.Actions) > 0:
+		if len(before) > 0 {
+			data.Actions = append([]Action{extensionAction(s.Name(), beforeName, before)}, data.Actions...)
+		}
+	default:
+		data.Stages[s.Stage()] = before
+		used = []string{s.Stage()}
+	}
+
+	if len(data.Actions) > 0 {
+		if len(after) > 0 {
+			data.Actions = append(data.Actions, extensionAction(s.Name(), afterName, after))
+		}
+	} else {
+		last := used[len(used)-1]
+		data.Stages[last] = append(data.Stages[last], after...)
+	}
 	return data
 }
@@ -0,0 +1,287 @@
+package stages_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+
+	semver "github.com/hashicorp/go-version"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/rs/zerolog"
+)
+
+var _ = Describe("Step extensions", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+	sis := values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}
+
+	indexOf := func(st []schema.Stage, name string) int {
+		for i, s := range st {
+			if s.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "hooks.yaml"), []byte(`
+stages:
+  before-initrd:
+    - name: before initrd
+  after-initrd:
+    - name: after initrd
+  before-cloudconfigs:
+    - name: before cloudconfigs
+  after-cloudconfigs:
+    - name: after cloudconfigs
+`), 0644)).To(Succeed())
+		config.DefaultConfig.Extensions = true
+		config.DefaultConfig.ExtensionsDirs = config.PathList{dir}
+		config.DefaultConfig.KairosVersion = *semver.Must(semver.NewVersion("1.0.0"))
+		// Don't look for a kernel in the running system
+		config.DefaultConfig.DryRun = true
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	It("runs the hooks around the stages of the step", func() {
+		plan, err := stages.BuildInitStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		before := indexOf(plan.Stages["init"], "before initrd")
+		initrd := indexOf(plan.Stages["init"], "Create new initrd")
+		after := indexOf(plan.Stages["init"], "after initrd")
+		Expect(before).To(BeNumerically(">=", 0))
+		Expect(initrd).To(BeNumerically(">", before))
+		Expect(after).To(BeNumerically(">", initrd))
+		// Nothing from the initrd step runs after the hook
+		Expect(plan.Stages["init"][after+1].Name).ToNot(ContainSubstring("initrd"))
+	})
+
+	It("runs the hooks around the actions of steps without stages", func() {
+		plan, err := stages.BuildInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		var cloudconfigs []stages.Action
+		for _, a := range plan.Actions {
+			if a.Step == values.CloudconfigsStep {
+				cloudconfigs = append(cloudconfigs, a)
+			}
+		}
+		Expect(len(cloudconfigs)).To(BeNumerically(">", 2))
+		Expect(cloudconfigs[0].Kind).To(Equal(stages.ActionExtension))
+		Expect(cloudconfigs[0].Source).To(Equal("before-cloudconfigs"))
+		Expect(cloudconfigs[0].Stages).To(HaveLen(1))
+		Expect(cloudconfigs[len(cloudconfigs)-1].Source).To(Equal("after-cloudconfigs"))
+	})
+
+	It("does not run the hooks of skipped steps", func() {
+		config.DefaultConfig.SkipSteps = []string{values.InitrdStep}
+		plan, err := stages.BuildInitStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(indexOf(plan.Stages["init"], "before initrd")).To(Equal(-1))
+		Expect(indexOf(plan.Stages["init"], "after initrd")).To(Equal(-1))
+	})
+})
+
+var _ = Describe("LoadExtensions", func() {
+	var log logger.KairosLogger
+	var dir string
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		dir = GinkgoT().TempDir()
+	})
+
+	It("loads the files in order", func() {
+		write("02.yaml", "stages:\n  init:\n    - name: second\n")
+		write("01.yml", "stages:\n  init:\n    - name: first\n  after-kernel:\n    - name: hook\n")
+		write("README.md", "not an extension")
+		ext, err := stages.LoadExtensions([]string{dir}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ext["init"]).To(HaveLen(2))
+		Expect(ext["init"][0].Name).To(Equal("first"))
+		Expect(ext["after-kernel"]).To(HaveLen(1))
+	})
+
+	It("reports every problem found", func() {
+		write("01.yaml", "stages:\n  init:\n    - name: typo\n      comands: [ls]\n")
+		write("02.yaml", "stages: [\n")
+		write("sub/03.yaml", "stages:\n  after-kernl:\n    - name: unknown\n  init:\n    - name: valid\n")
+		write("sub/04.yaml", "stages:\n  init:\n    - name: valid\n")
+		ext, err := stages.LoadExtensions([]string{dir}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("field comands not found"))
+		Expect(err.Error()).To(ContainSubstring("02.yaml"))
+		Expect(err.Error()).To(ContainSubstring(`unknown stage "after-kernl"`))
+		Expect(err.Error()).To(ContainSubstring(`duplicate stage name "valid"`))
+		// The valid stages are still returned
+		Expect(ext["init"]).To(HaveLen(1))
+	})
+
+	It("still loads the stages of the deprecated cloud-config files", func() {
+		write("01.yaml", "#cloud-config\nusers:\n  - name: kairos\nstages:\n  init:\n    - name: legacy\n")
+		ext, err := stages.LoadExtensions([]string{dir}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ext["init"]).To(HaveLen(1))
+		Expect(ext["init"][0].Name).To(Equal("legacy"))
+	})
+
+	It("renders the template files with the params", func() {
+		write("01.tmpl.yaml", `stages:
+  after-kernel:
+    - name: Kernel {{ .kernel }}
+{{- if eq .model "rpi4" }}
+    - name: Only for rpi4
+{{- end }}
+`)
+		ext, err := stages.LoadExtensions([]string{dir}, map[string]string{"kernel": "6.8.0-1-generic", "model": "rpi4"}, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ext["after-kernel"]).To(HaveLen(2))
+		Expect(ext["after-kernel"][0].Name).To(Equal("Kernel 6.8.0-1-generic"))
+
+		ext, err = stages.LoadExtensions([]string{dir}, map[string]string{"kernel": "6.8.0-1-generic", "model": "generic"}, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ext["after-kernel"]).To(HaveLen(1))
+	})
+
+	It("fails on unknown params", func() {
+		write("01.tmpl.yml", "stages:\n  init:\n    - name: {{ .kernell }}\n")
+		_, err := stages.LoadExtensions([]string{dir}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).To(MatchError(ContainSubstring("kernell")))
+	})
+
+	It("loads the plain files unchanged and warns about their {{", func() {
+		var out bytes.Buffer
+		log.Logger = zerolog.New(&out)
+		write("01.yaml", "stages:\n  init:\n    - name: Check the container\n      commands:\n        - docker inspect -f '{{.State}}' registry\n")
+		ext, err := stages.LoadExtensions([]string{dir}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ext["init"]).To(HaveLen(1))
+		Expect(ext["init"][0].Commands).To(Equal([]string{"docker inspect -f '{{.State}}' registry"}))
+		Expect(out.String()).To(ContainSubstring("rename it to .tmpl.yaml"))
+	})
+
+	It("has a placeholder for every param", func() {
+		params := stages.ExtensionTemplateParams(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+		Expect(stages.ExtensionPlaceholderParams()).To(HaveLen(len(params)))
+		for k := range params {
+			Expect(stages.ExtensionPlaceholderParams()).To(HaveKey(k))
+		}
+	})
+
+	It("fails on a missing dir", func() {
+		_, err := stages.LoadExtensions([]string{filepath.Join(dir, "missing")}, stages.ExtensionPlaceholderParams(), log)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with several sources", func() {
+		bundle := func(name string, files map[string]string) string {
+			path := filepath.Join(GinkgoT().TempDir(), name)
+			f, err := os.Create(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			gz := gzip.NewWriter(f)
+			tw := tar.NewWriter(gz)
+			for n, content := range files {
+				Expect(tw.WriteHeader(&tar.Header{Name: n, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+				_, err = tw.Write([]byte(content))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(gz.Close()).To(Succeed())
+			return path
+		}
+
+		It("loads them in order and lets later ones override stages by name", func() {
+			write("base.yaml", "stages:\n  init:\n    - name: motd\n      commands: [base]\n    - name: base only\n")
+			board := bundle("board.tar.gz", map[string]string{
+				"./board/01.yaml": "stages:\n  init:\n    - name: motd\n      commands: [board]\n    - name: board only\n",
+				"README.md":       "skipped",
+			})
+			ext, err := stages.LoadExtensions([]string{dir, board}, stages.ExtensionPlaceholderParams(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ext["init"]).To(HaveLen(3))
+			Expect(ext["init"][0].Name).To(Equal("motd"))
+			Expect(ext["init"][0].Commands).To(Equal([]string{"board"}))
+			Expect(ext["init"][1].Name).To(Equal("base only"))
+			Expect(ext["init"][2].Name).To(Equal("board only"))
+		})
+
+		It("reports problems with the name of the file in the bundle", func() {
+			board := bundle("board.tgz", map[string]string{"01.yaml": "stages:\n  after-kernl: []\n"})
+			_, err := stages.LoadExtensions([]string{board}, stages.ExtensionPlaceholderParams(), log)
+			Expect(err).To(MatchError(ContainSubstring(board + ":01.yaml")))
+		})
+
+		It("rejects bundles with paths outside of it", func() {
+			board := bundle("board.tar.gz", map[string]string{"../01.yaml": "stages: {}\n"})
+			_, err := stages.LoadExtensions([]string{board}, stages.ExtensionPlaceholderParams(), log)
+			Expect(err).To(MatchError(ContainSubstring("invalid path")))
+		})
+	})
+
+	Context("when building a stage", func() {
+		var previous config.Config
+
+		BeforeEach(func() {
+			previous = config.DefaultConfig
+			write("01.yaml", "stages:\n  after-kernl:\n    - name: unknown\n  init:\n    - name: valid\n")
+			config.DefaultConfig.Extensions = true
+			config.DefaultConfig.ExtensionsDirs = config.PathList{dir}
+			config.DefaultConfig.KairosVersion = *semver.Must(semver.NewVersion("1.0.0"))
+			config.DefaultConfig.DryRun = true
+		})
+
+		AfterEach(func() {
+			config.DefaultConfig = previous
+		})
+
+		It("fails on invalid extensions", func() {
+			_, err := stages.BuildInitStage(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("ignores the invalid extensions when lenient", func() {
+			config.DefaultConfig.ExtensionsLenient = true
+			plan, err := stages.BuildInitStage(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Stages["init"][len(plan.Stages["init"])-1].Name).To(Equal("valid"))
+		})
+
+		It("loads nothing if no dir is set and the default one doesn't exist", func() {
+			if _, err := os.Stat(stages.DefaultExtensionsDir); err == nil {
+				Skip("the default extensions dir exists in this system")
+			}
+			config.DefaultConfig.ExtensionsDirs = nil
+			ext, err := stages.GetExtensions(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ext).To(BeEmpty())
+		})
+
+		It("fails on a missing dir that was set", func() {
+			config.DefaultConfig.ExtensionsDirs = config.PathList{filepath.Join(dir, "missing")}
+			_, err := stages.GetExtensions(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
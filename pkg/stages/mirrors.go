@@ -0,0 +1,206 @@
+package stages
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// upstreamRepos are the upstream repositories that a mirror replaces by id, with the urls they are known by
+// The first url is the one put back when restoring the files that were added after the mirrors were set up.
+// Mirrors with any other id are the id of a dnf or zypper repository, which gets its baseurl replaced.
+var upstreamRepos = map[string][]string{
+	"ubuntu":          {"http://archive.ubuntu.com/ubuntu", "https://archive.ubuntu.com/ubuntu", "http://security.ubuntu.com/ubuntu", "https://security.ubuntu.com/ubuntu"},
+	"ubuntu-ports":    {"http://ports.ubuntu.com/ubuntu-ports", "https://ports.ubuntu.com/ubuntu-ports"},
+	"debian":          {"http://deb.debian.org/debian", "https://deb.debian.org/debian"},
+	"debian-security": {"http://deb.debian.org/debian-security", "https://deb.debian.org/debian-security", "http://security.debian.org/debian-security"},
+	"alpine":          {"https://dl-cdn.alpinelinux.org/alpine", "http://dl-cdn.alpinelinux.org/alpine"},
+	"opensuse":        {"https://download.opensuse.org", "http://download.opensuse.org", "https://cdn.opensuse.org", "http://cdn.opensuse.org"},
+	"fedoraproject":   {"https://dl.fedoraproject.org/pub"},
+	"nvidia-cuda":     {"https://developer.download.nvidia.com/compute/cuda/repos"},
+	"nvidia":          {"https://repo.download.nvidia.com"},
+}
+
+// archMirror is the id of the mirror for Arch Linux, which replaces the whole pacman mirrorlist
+const archMirror = "arch"
+
+// repoConfigs are the package manager files with the repositories, the ones backed up and changed for the mirrors
+var repoConfigs = []string{
+	"/etc/apt/sources.list",
+	"/etc/apt/sources.list.d/*.list",
+	"/etc/apt/sources.list.d/*.sources",
+	"/etc/yum.repos.d/*.repo",
+	"/etc/zypp/repos.d/*.repo",
+	"/etc/apk/repositories",
+	"/etc/pacman.conf",
+	"/etc/pacman.d/mirrorlist",
+}
+
+// mirrorsBackupDir is where the original repository files are kept to restore them
+const mirrorsBackupDir = "/var/lib/kairos-init/repos"
+
+// localRepoFiles are the repository files for the local repository by family, the ones not listed add it to an
+// existing file that is backed up instead
+var localRepoFiles = map[values.Family]string{
+	values.DebianFamily: "/etc/apt/sources.list.d/kairos-local.list",
+	values.RedHatFamily: "/etc/yum.repos.d/kairos-local.repo",
+	values.SUSEFamily:   "/etc/zypp/repos.d/kairos-local.repo",
+}
+
+// urlBoundary is what can follow an upstream url for it to be replaced, so debian doesn't match debian-security
+const urlBoundary = `([^-[:alnum:]_.]|$)`
+
+// mirrorReplacement is an upstream url and the mirror that replaces it
+type mirrorReplacement struct {
+	upstream string
+	mirror   string
+}
+
+// mirrorReplacements returns the upstream urls replaced by the configured mirrors, sorted by id so the stages are
+// always the same for the same config
+func mirrorReplacements() []mirrorReplacement {
+	var replacements []mirrorReplacement
+	for _, id := range slices.Sorted(maps.Keys(config.DefaultConfig.Mirrors.Repos)) {
+		for _, upstream := range upstreamRepos[id] {
+			replacements = append(replacements, mirrorReplacement{upstream: upstream, mirror: strings.TrimSuffix(config.DefaultConfig.Mirrors.Repos[id], "/")})
+		}
+	}
+	return replacements
+}
+
+// mirrorRepoIDs returns the dnf and zypper repository ids with a mirror, sorted
+func mirrorRepoIDs() []string {
+	var ids []string
+	for _, id := range slices.Sorted(maps.Keys(config.DefaultConfig.Mirrors.Repos)) {
+		if _, upstream := upstreamRepos[id]; !upstream && id != archMirror {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// withMirrors replaces the upstream urls in the commands and files of the stages with their mirrors, so the
+// repositories that kairos-init adds itself use them too
+func withMirrors(stages []schema.Stage) []schema.Stage {
+	replacements := mirrorReplacements()
+	if len(replacements) == 0 {
+		return stages
+	}
+	replace := func(s string) string {
+		for _, r := range replacements {
+			s = regexp.MustCompile(regexp.QuoteMeta(r.upstream)+urlBoundary).ReplaceAllString(s, r.mirror+"${1}")
+		}
+		return s
+	}
+	for i := range stages {
+		for j := range stages[i].Commands {
+			stages[i].Commands[j] = replace(stages[i].Commands[j])
+		}
+		for j := range stages[i].Files {
+			stages[i].Files[j].Content = replace(stages[i].Files[j].Content)
+		}
+	}
+	return stages
+}
+
+// mirrorsStages returns the stages that point the repositories of the system to the mirrors and add the local
+// repository. They back up the original files first, the backup is kept from the first run so it can run again
+// to catch the repositories added since, like the EPEL one.
+func mirrorsStages(name string, sis values.System) []schema.Stage {
+	mirrors := config.DefaultConfig.Mirrors
+	if !mirrors.Enabled() {
+		return nil
+	}
+
+	var expressions []string
+	for _, r := range mirrorReplacements() {
+		expressions = append(expressions, fmt.Sprintf("-e 's#%s%s#%s\\1#g'", regexp.QuoteMeta(r.upstream), urlBoundary, sedEscape(r.mirror)))
+	}
+	for _, id := range mirrorRepoIDs() {
+		section := regexp.QuoteMeta("[" + id + "]")
+		expressions = append(expressions,
+			fmt.Sprintf("-e '/^%s/,/^\\[/{/^(baseurl|metalink|mirrorlist)=/d;}'", section),
+			fmt.Sprintf("-e '/^%s$/a baseurl=%s'", section, mirrors.Repos[id]),
+		)
+	}
+
+	script := fmt.Sprintf(`backup=%s
+for f in %s; do
+  [ -f "$f" ] || continue
+  [ -e "$backup$f" ] || { mkdir -p "$backup$(dirname "$f")" && cp -p "$f" "$backup$f"; }`, mirrorsBackupDir, strings.Join(repoConfigs, " "))
+	if len(expressions) > 0 {
+		script += fmt.Sprintf(`
+  sed -E -i %s "$f"`, strings.Join(expressions, " "))
+	}
+	script += "\ndone"
+	if u, ok := mirrors.Repos[archMirror]; ok {
+		script += fmt.Sprintf(`
+if [ -f /etc/pacman.d/mirrorlist ]; then
+  echo 'Server = %s/$repo/os/$arch' > /etc/pacman.d/mirrorlist
+fi`, strings.TrimSuffix(u, "/"))
+	}
+
+	stage := schema.Stage{Name: name, Commands: []string{script}}
+	if mirrors.Local != "" {
+		switch sis.Family {
+		case values.DebianFamily:
+			stage.Files = append(stage.Files, schema.File{Path: localRepoFiles[sis.Family], Permissions: 0644, Content: fmt.Sprintf("deb [trusted=yes] file:%s ./\n", mirrors.Local)})
+		case values.RedHatFamily:
+			stage.Files = append(stage.Files, schema.File{Path: localRepoFiles[sis.Family], Permissions: 0644, Content: fmt.Sprintf("[kairos-local]\nname=kairos-init local repository\nbaseurl=file://%s\nenabled=1\ngpgcheck=0\n", mirrors.Local)})
+		case values.SUSEFamily:
+			stage.Files = append(stage.Files, schema.File{Path: localRepoFiles[sis.Family], Permissions: 0644, Content: fmt.Sprintf("[kairos-local]\nname=kairos-init local repository\nbaseurl=file://%s\nenabled=1\nautorefresh=1\ngpgcheck=0\ntype=rpm-md\n", mirrors.Local)})
+		case values.AlpineFamily:
+			// The index has to be signed with a key in /etc/apk/keys, as the packages are installed without --allow-untrusted
+			stage.Commands = append(stage.Commands, fmt.Sprintf("grep -qxF '%[1]s' /etc/apk/repositories || echo '%[1]s' >> /etc/apk/repositories", mirrors.Local))
+		case values.ArchFamily:
+			stage.Commands = append(stage.Commands, fmt.Sprintf(`grep -q '^\[kairos-local\]' /etc/pacman.conf || printf '\n[kairos-local]\nSigLevel = Optional TrustAll\nServer = file://%s\n' >> /etc/pacman.conf`, mirrors.Local))
+		}
+	}
+	return []schema.Stage{stage}
+}
+
+// restoreMirrorsStages returns the stages that put back the original repositories, if requested
+// The files added after the mirrors were set up have no backup, so their mirrors are replaced with the upstream urls
+func restoreMirrorsStages() []schema.Stage {
+	mirrors := config.DefaultConfig.Mirrors
+	if !mirrors.Enabled() || !mirrors.Restore {
+		return nil
+	}
+
+	var expressions []string
+	for _, id := range slices.Sorted(maps.Keys(mirrors.Repos)) {
+		if upstream, ok := upstreamRepos[id]; ok {
+			expressions = append(expressions, fmt.Sprintf("-e 's#%s%s#%s\\1#g'", regexp.QuoteMeta(strings.TrimSuffix(mirrors.Repos[id], "/")), urlBoundary, sedEscape(upstream[0])))
+		}
+	}
+	script := fmt.Sprintf(`backup=%s
+for f in %s; do
+  [ -f "$f" ] || continue
+  if [ -f "$backup$f" ]; then
+    cp -p "$backup$f" "$f"`, mirrorsBackupDir, strings.Join(repoConfigs, " "))
+	if len(expressions) > 0 {
+		script += fmt.Sprintf(`
+  else
+    sed -E -i %s "$f"`, strings.Join(expressions, " "))
+	}
+	script += "\n  fi\ndone"
+
+	files := []string{`"$backup"`}
+	for _, family := range []values.Family{values.DebianFamily, values.RedHatFamily, values.SUSEFamily} {
+		files = append(files, localRepoFiles[family])
+	}
+	script += "\nrm -rf " + strings.Join(files, " ")
+
+	return []schema.Stage{{Name: "Restore the original repositories", Commands: []string{script}}}
+}
+
+// sedEscape escapes the replacement of a sed s command that uses # as the delimiter
+func sedEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `&`, `\&`, `#`, `\#`).Replace(s)
+}
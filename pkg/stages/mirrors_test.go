@@ -0,0 +1,126 @@
+package stages
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// runInDir runs the script with the absolute paths it uses moved under dir, as it would run in the target system
+func runInDir(t *testing.T, dir, script string) {
+	t.Helper()
+	script = strings.NewReplacer(" /etc/", " "+dir+"/etc/", "=/var/", "="+dir+"/var/").Replace(script)
+	if out, err := exec.Command("sh", "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v: %s", err, out)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMirrorsScripts(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Mirrors = config.Mirrors{
+		Repos: map[string]string{
+			"ubuntu": "http://mirror.local/ubuntu/",
+			"debian": "http://mirror.local/debian",
+			"epel":   "http://mirror.local/epel/$releasever/Everything/$basearch/",
+		},
+		Restore: true,
+	}
+
+	dir := t.TempDir()
+	sources := "deb http://archive.ubuntu.com/ubuntu noble main\ndeb http://security.ubuntu.com/ubuntu/ noble-security main\ndeb http://deb.debian.org/debian-security bookworm-security main\n"
+	epel := "[epel]\nname=EPEL\nmetalink=https://mirrors.fedoraproject.org/metalink?repo=epel-$releasever\nenabled=1\n\n[epel-testing]\nmetalink=https://mirrors.fedoraproject.org/metalink?repo=testing\n"
+	for path, content := range map[string]string{"etc/apt/sources.list": sources, "etc/yum.repos.d/epel.repo": epel} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stages := mirrorsStages("mirrors", values.System{Family: values.DebianFamily})
+	if len(stages) != 1 {
+		t.Fatalf("expected the mirrors stage, got %v", stages)
+	}
+	runInDir(t, dir, stages[0].Commands[0])
+	// Running it again doesn't overwrite the backup
+	runInDir(t, dir, stages[0].Commands[0])
+
+	got := readFile(t, filepath.Join(dir, "etc/apt/sources.list"))
+	expected := "deb http://mirror.local/ubuntu noble main\ndeb http://mirror.local/ubuntu/ noble-security main\ndeb http://deb.debian.org/debian-security bookworm-security main\n"
+	if got != expected {
+		t.Errorf("unexpected sources.list:\n%s", got)
+	}
+	got = readFile(t, filepath.Join(dir, "etc/yum.repos.d/epel.repo"))
+	if !strings.Contains(got, "[epel]\nbaseurl=http://mirror.local/epel/$releasever/Everything/$basearch/\nname=EPEL\nenabled=1\n") {
+		t.Errorf("expected the epel baseurl to be set, got:\n%s", got)
+	}
+	if !strings.Contains(got, "[epel-testing]\nmetalink=") {
+		t.Errorf("expected other repositories to be untouched, got:\n%s", got)
+	}
+
+	// A repository added by kairos-init itself after the mirrors were set up
+	added := filepath.Join(dir, "etc/apt/sources.list.d/added.list")
+	if err := os.MkdirAll(filepath.Dir(added), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(added, []byte("deb http://mirror.local/ubuntu noble main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := restoreMirrorsStages()
+	if len(restore) != 1 {
+		t.Fatalf("expected the restore stage, got %v", restore)
+	}
+	runInDir(t, dir, restore[0].Commands[0])
+	if got = readFile(t, filepath.Join(dir, "etc/apt/sources.list")); got != sources {
+		t.Errorf("expected the original sources.list, got:\n%s", got)
+	}
+	if got = readFile(t, filepath.Join(dir, "etc/yum.repos.d/epel.repo")); got != epel {
+		t.Errorf("expected the original epel.repo, got:\n%s", got)
+	}
+	if got = readFile(t, added); got != "deb http://archive.ubuntu.com/ubuntu noble main\n" {
+		t.Errorf("expected the added repository to use the upstream url, got:\n%s", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, mirrorsBackupDir)); !os.IsNotExist(err) {
+		t.Errorf("expected the backup to be removed, got %v", err)
+	}
+}
+
+func TestWithMirrors(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Mirrors = config.Mirrors{Repos: map[string]string{"fedoraproject": "http://mirror.local/fedora", "debian": "http://mirror.local/debian"}}
+
+	stages := withMirrors([]schema.Stage{{
+		Commands: []string{"dnf install -y https://dl.fedoraproject.org/pub/epel/epel-release-latest-9.noarch.rpm"},
+		Files:    []schema.File{{Content: "deb http://deb.debian.org/debian bookworm main\ndeb http://deb.debian.org/debian-security bookworm-security main"}},
+	}})
+	if stages[0].Commands[0] != "dnf install -y http://mirror.local/fedora/epel/epel-release-latest-9.noarch.rpm" {
+		t.Errorf("unexpected command %s", stages[0].Commands[0])
+	}
+	if stages[0].Files[0].Content != "deb http://mirror.local/debian bookworm main\ndeb http://deb.debian.org/debian-security bookworm-security main" {
+		t.Errorf("unexpected file content %s", stages[0].Files[0].Content)
+	}
+
+	config.DefaultConfig.Mirrors = config.Mirrors{}
+	if mirrorsStages("mirrors", values.System{}) != nil || restoreMirrorsStages() != nil {
+		t.Errorf("expected no stages without mirrors")
+	}
+}
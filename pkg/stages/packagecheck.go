@@ -0,0 +1,115 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// packageManager are the commands to check if a package is available in the repositories of the system and install it
+// Available is run with the package name in $p and has to fail if it is not available
+type packageManager struct {
+	refresh   string
+	available string
+	install   string
+}
+
+// packageManagers are the package managers by family, with the same options yip uses to install the packages
+var packageManagers = map[values.Family]packageManager{
+	values.DebianFamily: {
+		refresh:   "apt-get -y update",
+		available: `apt-cache policy "$p" 2>/dev/null | grep -Eq 'Candidate: [^(]'`,
+		install:   "DEBIAN_FRONTEND=noninteractive apt-get -y --no-install-recommends install",
+	},
+	values.RedHatFamily: {
+		refresh:   "dnf makecache",
+		available: `dnf info -q "$p" >/dev/null 2>&1`,
+		install:   "dnf install -y --setopt=install_weak_deps=False",
+	},
+	values.SUSEFamily: {
+		refresh:   "zypper refresh",
+		available: `zypper -n info "$p" 2>/dev/null | grep -q '^Name *:'`,
+		install:   "zypper install -y --no-recommends",
+	},
+	values.AlpineFamily: {
+		refresh:   "apk update",
+		available: `[ -n "$(apk search -e "$p")" ]`,
+		install:   "apk add --no-cache",
+	},
+	values.ArchFamily: {
+		refresh:   "pacman -Sy --noconfirm",
+		available: `pacman -Si "$p" >/dev/null 2>&1`,
+		install:   "pacman -S --noconfirm",
+	},
+}
+
+// withPackageCheck checks that the packages of the named stage are available before installing them, so all the
+// missing ones are reported at once instead of failing on the first one the package manager finds.
+// The optional packages are taken out of the stage and installed right after it, only the ones that are available.
+func withPackageCheck(stages []schema.Stage, name string, sis values.System, l logger.KairosLogger) []schema.Stage {
+	i := slices.IndexFunc(stages, func(s schema.Stage) bool { return s.Name == name })
+	pm, ok := packageManagers[sis.Family]
+	if i < 0 || !ok {
+		return stages
+	}
+
+	var required, optional []string
+	for _, p := range stages[i].Packages.Install {
+		if slices.Contains(config.DefaultConfig.OptionalPackages, p) {
+			optional = append(optional, p)
+			continue
+		}
+		required = append(required, p)
+	}
+	stages[i].Packages.Install = required
+
+	if len(optional) > 0 {
+		l.Logger.Debug().Strs("packages", optional).Msg("Installing the optional packages only if they are available")
+		stages = slices.Insert(stages, i+1, schema.Stage{
+			Name:     fmt.Sprintf("%s: optional ones that are available", name),
+			Commands: []string{optionalPackagesScript(pm, optional)},
+		})
+	}
+	if !config.DefaultConfig.SkipPackageCheck && len(required) > 0 {
+		stages = slices.Insert(stages, i, schema.Stage{
+			Name:     fmt.Sprintf("%s: check they are available", name),
+			Commands: []string{packageCheckScript(pm, required)},
+		})
+	}
+	return stages
+}
+
+// packageCheckScript fails listing all the packages that are not available
+func packageCheckScript(pm packageManager, packages []string) string {
+	return fmt.Sprintf(`%s >/dev/null
+missing=""
+for p in %s; do
+  %s || missing="$missing $p"
+done
+if [ -n "$missing" ]; then
+  echo "Packages not available in the repositories:$missing"
+  echo "Exclude them, replace them with a package overlay or set them as optional packages"
+  exit 1
+fi`, pm.refresh, strings.Join(packages, " "), pm.available)
+}
+
+// optionalPackagesScript installs the packages that are available and skips the rest
+func optionalPackagesScript(pm packageManager, packages []string) string {
+	return fmt.Sprintf(`%s >/dev/null
+available=""
+for p in %s; do
+  if %s; then
+    available="$available $p"
+  else
+    echo "Skipping the optional package $p, it is not available in the repositories"
+  fi
+done
+if [ -n "$available" ]; then
+  %s $available
+fi`, pm.refresh, strings.Join(packages, " "), pm.available, pm.install)
+}
@@ -0,0 +1,34 @@
+package stages
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPackageCheckScripts(t *testing.T) {
+	pm := packageManager{
+		refresh:   "true",
+		available: `case "$p" in curl|vim) true ;; *) false ;; esac`,
+		install:   "echo installing",
+	}
+
+	out, err := exec.Command("sh", "-c", packageCheckScript(pm, []string{"curl", "nano", "vim", "fail2ban"})).CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the check to fail, got %s", out)
+	}
+	if !strings.Contains(string(out), "not available in the repositories: nano fail2ban") {
+		t.Errorf("expected all the missing packages at once, got %s", out)
+	}
+	if out, err = exec.Command("sh", "-c", packageCheckScript(pm, []string{"curl", "vim"})).CombinedOutput(); err != nil {
+		t.Errorf("unexpected error: %v: %s", err, out)
+	}
+
+	out, err = exec.Command("sh", "-c", optionalPackagesScript(pm, []string{"curl", "nano", "vim"})).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unexpected error: %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "Skipping the optional package nano") || !strings.Contains(string(out), "installing curl vim") {
+		t.Errorf("expected only the available packages to be installed, got %s", out)
+	}
+}
@@ -0,0 +1,132 @@
+package stages
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// Plan is everything a kairos-init stage would do to the system: the yip stages that get executed
+// plus the actions that are applied directly, outside of yip
+type Plan struct {
+	Stages  map[string][]schema.Stage `yaml:"stages" json:"stages"`
+	Actions []Action                  `yaml:"actions,omitempty" json:"actions,omitempty"`
+	// steps keeps the plan of each step so they can be run and tracked one by one
+	steps []stepPlan
+	// extensions are the stages loaded from disk for each phase, they run after the steps of the phase
+	extensions map[string][]schema.Stage
+}
+
+// stepPlan is the part of a plan built by a single step
+type stepPlan struct {
+	name string
+	plan Plan
+}
+
+// NewPlan returns an empty plan
+func NewPlan() Plan {
+	return Plan{Stages: map[string][]schema.Stage{}, extensions: map[string][]schema.Stage{}}
+}
+
+// YipConfig returns the yip stages of the plan as a yip config
+func (p Plan) YipConfig() schema.YipConfig {
+	return schema.YipConfig{Stages: p.Stages}
+}
+
+// Merge appends the stages and actions of other to the plan
+func (p *Plan) Merge(other Plan) {
+	for stageName, stages := range other.Stages {
+		p.Stages[stageName] = append(p.Stages[stageName], stages...)
+	}
+	p.Actions = append(p.Actions, other.Actions...)
+	p.steps = append(p.steps, other.steps...)
+	for stageName, stages := range other.extensions {
+		p.extensions[stageName] = append(p.extensions[stageName], stages...)
+	}
+}
+
+// addStep merges the plan of the given step
+func (p *Plan) addStep(name string, built Plan) {
+	p.Merge(built)
+	p.steps = append(p.steps, stepPlan{name: name, plan: built})
+}
+
+// addExtensions adds the stages from disk at the end of the given phase
+func (p *Plan) addExtensions(phase string, stages []schema.Stage) {
+	p.Stages[phase] = append(p.Stages[phase], stages...)
+	p.extensions[phase] = append(p.extensions[phase], stages...)
+}
+
+// ToYAML renders the plan as yaml
+func (p Plan) ToYAML() (string, error) {
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(p); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ToJSON renders the plan as json
+// yip stages only carry yaml tags, so we go through yaml first to keep the same keys in both formats
+func (p Plan) ToJSON() (string, error) {
+	y, err := p.ToYAML()
+	if err != nil {
+		return "", err
+	}
+	var data interface{}
+	if err = yaml.Unmarshal([]byte(y), &data); err != nil {
+		return "", err
+	}
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// PlanInstallStage returns what the install stage would do without running it
+func PlanInstallStage(logger logger.KairosLogger) (Plan, error) {
+	if config.ContainsSkipStep(values.InstallStage) {
+		logger.Logger.Warn().Msg("Skipping install stage as per configuration")
+		return NewPlan(), nil
+	}
+	sis := system.DetectSystem(config.RootPath("/"), logger)
+	return BuildInstallStage(sis, logger)
+}
+
+// PlanInitStage returns what the init stage would do without running it
+func PlanInitStage(logger logger.KairosLogger) (Plan, error) {
+	if config.ContainsSkipStep(values.InitStage) {
+		logger.Logger.Warn().Msg("Skipping init stage as per configuration")
+		return NewPlan(), nil
+	}
+	sis := system.DetectSystem(config.RootPath("/"), logger)
+	return BuildInitStage(sis, logger)
+}
+
+// PlanAllStages returns what all the stages would do without running them
+// As the install stage is not run, anything the init stage reads from the system (like the kernel version) may not
+// be there yet, so placeholders are used instead
+func PlanAllStages(logger logger.KairosLogger) (Plan, error) {
+	fullPlan := NewPlan()
+	installPlan, err := PlanInstallStage(logger)
+	if err != nil {
+		return installPlan, err
+	}
+	fullPlan.Merge(installPlan)
+
+	initPlan, err := PlanInitStage(logger)
+	if err != nil {
+		return fullPlan, err
+	}
+	fullPlan.Merge(initPlan)
+	return fullPlan, nil
+}
@@ -0,0 +1,146 @@
+package stages_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kairos-io/kairos-init/pkg/bundled"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/constants"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+var _ = Describe("Plan", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+	sis := values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	Describe("GetInstallKairosBinariesActions", func() {
+		It("writes the embedded binaries in a stable order", func() {
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			Expect(len(actions)).To(BeNumerically(">=", 3))
+			Expect(actions[0].Dest).To(Equal(constants.AgentDefaultPath))
+			Expect(actions[1].Dest).To(Equal("/usr/bin/immucore"))
+			Expect(actions[2].Dest).To(Equal("/system/discovery/kcrypt-discovery-challenger"))
+			for _, a := range actions {
+				Expect(a.Kind).To(Equal(stages.ActionWriteFile))
+				Expect(a.Step).To(Equal(values.KairosBinariesStep))
+				Expect(a.Source).To(HavePrefix("embedded:"))
+			}
+		})
+
+		It("downloads overridden versions", func() {
+			config.DefaultConfig.VersionOverrides.Agent = "v2.20.0"
+			config.DefaultConfig.Fips = true
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			Expect(actions[0].Kind).To(Equal(stages.ActionDownload))
+			Expect(actions[0].Source).To(Equal("https://github.com/kairos-io/kairos-agent/releases/download/v2.20.0/kairos-agent-v2.20.0-Linux-amd64-fips.tar.gz"))
+		})
+
+		It("downloads overridden versions from the url templates", func() {
+			config.DefaultConfig.VersionOverrides.Immucore = "v0.9.0"
+			config.DefaultConfig.VersionOverrides.URLTemplates = map[string]string{
+				config.DefaultURLTemplate: "https://mirror.local/{{.Org}}/{{.Repo}}/{{.Version}}/{{.Repo}}-{{.ArchAlias}}.tar.gz",
+			}
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			Expect(actions[1].Kind).To(Equal(stages.ActionDownload))
+			Expect(actions[1].Source).To(Equal("https://mirror.local/kairos-io/immucore/v0.9.0/immucore-x86_64.tar.gz"))
+		})
+
+		It("uses urls and local paths as they are", func() {
+			config.DefaultConfig.VersionOverrides.Agent = "https://example.com/kairos-agent"
+			config.DefaultConfig.VersionOverrides.Immucore = "file:///build/immucore.tar.gz"
+			config.DefaultConfig.VersionOverrides.KcryptChallenger = "/build/bin"
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			Expect(actions[0].Kind).To(Equal(stages.ActionDownload))
+			Expect(actions[0].Source).To(Equal("https://example.com/kairos-agent"))
+			Expect(actions[0].Version).To(BeEmpty())
+			Expect(actions[1].Kind).To(Equal(stages.ActionCopy))
+			Expect(actions[1].Source).To(Equal("/build/immucore.tar.gz"))
+			Expect(actions[2].Kind).To(Equal(stages.ActionCopy))
+			Expect(actions[2].Source).To(Equal("/build/bin"))
+		})
+
+		It("writes the FIPS builds for FIPS images", func() {
+			config.DefaultConfig.Root = GinkgoT().TempDir()
+			config.DefaultConfig.Fips = true
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			for i, embedded := range [][]byte{bundled.EmbeddedAgentFips, bundled.EmbeddedImmucoreFips, bundled.EmbeddedKcryptChallengerFips} {
+				Expect(actions[i].Kind).To(Equal(stages.ActionWriteFile))
+				Expect(actions[i].Apply(log)).To(Succeed())
+				Expect(os.ReadFile(filepath.Join(config.DefaultConfig.Root, actions[i].Dest))).To(Equal(embedded))
+			}
+		})
+
+		It("writes the binaries into the root", func() {
+			config.DefaultConfig.Root = GinkgoT().TempDir()
+			actions := stages.GetInstallKairosBinariesActions(sis, log)
+			Expect(actions[0].Apply(log)).To(Succeed())
+			Expect(filepath.Join(config.DefaultConfig.Root, constants.AgentDefaultPath)).To(BeARegularFile())
+		})
+	})
+
+	Describe("GetInstallProviderBinariesActions", func() {
+		It("does nothing for core images", func() {
+			config.DefaultConfig.Variant = config.CoreVariant
+			Expect(stages.GetInstallProviderBinariesActions(sis, log)).To(BeEmpty())
+		})
+
+		It("uses the edgevpn release naming for overrides and links the provider", func() {
+			config.DefaultConfig.Variant = config.StandardVariant
+			config.DefaultConfig.VersionOverrides.EdgeVpn = "v0.30.0"
+			actions := stages.GetInstallProviderBinariesActions(sis, log)
+			Expect(actions).To(HaveLen(3))
+			Expect(actions[1].Source).To(Equal("https://github.com/mudler/edgevpn/releases/download/v0.30.0/edgevpn-v0.30.0-Linux-x86_64.tar.gz"))
+			Expect(actions[2].Kind).To(Equal(stages.ActionSymlink))
+			Expect(actions[2].Dest).To(Equal("/usr/bin/kairos"))
+		})
+	})
+
+	Describe("rendering", func() {
+		It("uses the same keys for yaml and json", func() {
+			plan := stages.NewPlan()
+			plan.Stages["init"] = []schema.Stage{{Name: "test", Commands: []string{"true"}, OnlyIfOs: "Ubuntu.*"}}
+			plan.Actions = []stages.Action{{Step: values.CloudconfigsStep, Kind: stages.ActionWriteFile, Dest: "/system/oem/test.yaml"}}
+
+			y, err := plan.ToYAML()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(y).To(ContainSubstring("only_os: Ubuntu.*"))
+
+			j, err := plan.ToJSON()
+			Expect(err).ToNot(HaveOccurred())
+			var decoded map[string]interface{}
+			Expect(json.Unmarshal([]byte(j), &decoded)).To(Succeed())
+			Expect(decoded).To(HaveKey("stages"))
+			Expect(decoded).To(HaveKey("actions"))
+			Expect(j).To(ContainSubstring(`"only_os": "Ubuntu.*"`))
+		})
+
+		It("merges plans", func() {
+			plan := stages.NewPlan()
+			other := stages.NewPlan()
+			other.Stages["init"] = []schema.Stage{{Name: "a"}}
+			other.Actions = []stages.Action{{Step: "x"}}
+			plan.Merge(other)
+			plan.Merge(other)
+			Expect(plan.Stages["init"]).To(HaveLen(2))
+			Expect(plan.Actions).To(HaveLen(2))
+		})
+	})
+})
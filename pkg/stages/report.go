@@ -0,0 +1,208 @@
+package stages
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/bundled"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"gopkg.in/yaml.v3"
+)
+
+// The status of a step in the report
+const (
+	StepCompleted = "completed"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+	StepNotRun    = "not-run" // An earlier phase failed before the step could run
+)
+
+// Report is the record of what a kairos-init run did, written as json at the end of the run
+type Report struct {
+	Version    string                `json:"version"`
+	Started    time.Time             `json:"started"`
+	Finished   time.Time             `json:"finished"`
+	DurationMs int64                 `json:"duration_ms"`
+	Error      string                `json:"error,omitempty"`
+	System     *values.System        `json:"system,omitempty"`
+	Steps      []StepReport          `json:"steps"`
+	Packages   map[string][]string   `json:"packages,omitempty"` // Resolved packages by step
+	Binaries   []BinaryReport        `json:"binaries,omitempty"`
+	Providers  []ProviderEventReport `json:"providers,omitempty"`
+	mu         sync.Mutex
+}
+
+// StepReport is what happened with a step
+type StepReport struct {
+	Name       string `json:"name"`
+	Stage      string `json:"stage"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BinaryReport is a binary installed by kairos-init
+type BinaryReport struct {
+	Name    string `json:"name"`
+	Dest    string `json:"dest"`
+	Source  string `json:"source"` // embedded, the url it was downloaded from or the local path it was copied from
+	Version string `json:"version,omitempty"`
+}
+
+// ProviderEventReport is the response of a provider to the build-install event
+type ProviderEventReport struct {
+	Plugin string `json:"plugin"`
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+}
+
+var report = newReport()
+
+func newReport() *Report {
+	return &Report{Version: values.GetVersion(), Started: time.Now().UTC(), Packages: map[string][]string{}}
+}
+
+// step returns the report entry of the step, adding it if needed
+func (r *Report) step(name string) *StepReport {
+	for i := range r.Steps {
+		if r.Steps[i].Name == name {
+			return &r.Steps[i]
+		}
+	}
+	stage := ""
+	if s, ok := GetStep(name); ok {
+		stage = s.Stage()
+	}
+	r.Steps = append(r.Steps, StepReport{Name: name, Stage: stage, Status: StepNotRun})
+	return &r.Steps[len(r.Steps)-1]
+}
+
+// stepSkipped records the step as skipped
+func (r *Report) stepSkipped(name, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.step(name)
+	s.Status = StepSkipped
+	s.Reason = reason
+}
+
+// stageSkipped records all the steps of the stage as skipped
+func (r *Report) stageSkipped(stage string) {
+	for _, s := range Steps(stage) {
+		r.stepSkipped(s.Name(), fmt.Sprintf("the %s stage is skipped as per configuration", stage))
+	}
+}
+
+// stagePending records the steps of the plan as not run yet
+func (r *Report) stagePending(plan Plan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sp := range plan.steps {
+		r.step(sp.name)
+	}
+}
+
+// stepRan adds the time spent on a part of the step and its result
+// A step is completed once all its parts ran, so the tracker calls stepCompleted
+func (r *Report) stepRan(name string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.step(name)
+	s.DurationMs += d.Milliseconds()
+	if err != nil {
+		s.Status = StepFailed
+		s.Error = err.Error()
+	}
+}
+
+// stepCompleted records the step as completed
+func (r *Report) stepCompleted(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.step(name)
+	if s.Status != StepFailed {
+		s.Status = StepCompleted
+	}
+}
+
+// setSystem records the detected system
+func (r *Report) setSystem(sis values.System) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.System = &sis
+}
+
+// setPackages records the packages resolved for the step
+func (r *Report) setPackages(step string, packages []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Packages[step] = packages
+}
+
+// addActions records the binaries installed by the actions
+func (r *Report) addActions(actions []Action) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range actions {
+		if a.Kind != ActionWriteFile && a.Kind != ActionDownload && a.Kind != ActionCopy {
+			continue
+		}
+		if a.Step != values.KairosBinariesStep && a.Step != values.ProviderBinariesStep {
+			continue
+		}
+		b := BinaryReport{Name: filepath.Base(a.Dest), Dest: a.Dest, Source: a.Source, Version: a.Version}
+		if a.Kind == ActionWriteFile {
+			b.Source = "embedded"
+		}
+		r.Binaries = append(r.Binaries, b)
+	}
+}
+
+// addProviderEvent records the response of a provider
+func (r *Report) addProviderEvent(e ProviderEventReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Providers = append(r.Providers, e)
+}
+
+// WriteReport finishes the report with the result of the run and writes it as json into the target system
+func WriteReport(path string, runErr error) error {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Finished = time.Now().UTC()
+	report.DurationMs = report.Finished.Sub(report.Started).Milliseconds()
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	// Steps are added as they are skipped or run, sort them in the order they are run
+	order := map[string]int{}
+	for _, stage := range stageDescriptions {
+		for _, s := range Steps(stage.Key) {
+			order[s.Name()] = len(order)
+		}
+	}
+	sort.SliceStable(report.Steps, func(i, j int) bool { return order[report.Steps[i].Name] < order[report.Steps[j].Name] })
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	path = config.RootPath(path)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// embeddedVersions are the versions of the embedded binaries by name
+var embeddedVersions = sync.OnceValue(func() map[string]string {
+	versions := map[string]string{}
+	_ = yaml.Unmarshal(bundled.EmbeddedVersionInfo, &versions)
+	return versions
+})
@@ -0,0 +1,90 @@
+package stages
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+func TestWriteReport(t *testing.T) {
+	previous := config.DefaultConfig
+	t.Cleanup(func() {
+		config.DefaultConfig = previous
+		report = newReport()
+	})
+	config.DefaultConfig = config.Config{Root: t.TempDir(), SkipSteps: []string{values.CleanupStep}}
+	report = newReport()
+	l := logger.NewKairosLogger("test", "error", true)
+
+	runErr := runPlan(writeFilePlan(map[string]string{}, values.InstallKernelStep), installPhases, l)
+	report.stepSkipped(values.CleanupStep, "skipped as per configuration")
+	report.setSystem(values.System{Distro: values.Ubuntu, Version: "24.04", Arch: values.ArchAMD64})
+	report.addActions([]Action{
+		{Step: values.KairosBinariesStep, Kind: ActionWriteFile, Source: embeddedSource("immucore"), Dest: "/usr/bin/immucore", Version: "v0.1.0"},
+		{Step: values.ProviderBinariesStep, Kind: ActionSymlink, Source: "/system/providers/agent-provider-kairos", Dest: "/usr/bin/kairos"},
+		{Step: values.CloudconfigsStep, Kind: ActionWriteFile, Source: embeddedSource("cloudconfigs/01_defaults.yaml"), Dest: "/system/oem/01_defaults.yaml"},
+	})
+	if err := WriteReport(config.DefaultReportPath, runErr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.DefaultConfig.Root, config.DefaultReportPath))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got Report
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+
+	if got.Error == "" {
+		t.Errorf("expected the run error in the report")
+	}
+	if got.System == nil || got.System.Distro != values.Ubuntu {
+		t.Errorf("expected the detected system in the report, got %+v", got.System)
+	}
+	want := []struct{ name, stage, status string }{
+		{values.InstallPackagesStep, values.InstallStage, StepCompleted},
+		{values.InstallKernelStep, values.InstallStage, StepFailed},
+		{values.CleanupStep, values.InitStage, StepSkipped},
+	}
+	if len(got.Steps) != len(want) {
+		t.Fatalf("expected %d steps, got %+v", len(want), got.Steps)
+	}
+	for i, w := range want {
+		if got.Steps[i].Name != w.name || got.Steps[i].Stage != w.stage || got.Steps[i].Status != w.status {
+			t.Errorf("expected step %d to be %s/%s %s, got %+v", i, w.stage, w.name, w.status, got.Steps[i])
+		}
+	}
+	if len(got.Binaries) != 1 || got.Binaries[0].Source != "embedded" || got.Binaries[0].Version != "v0.1.0" {
+		t.Errorf("expected only the immucore binary, got %+v", got.Binaries)
+	}
+}
+
+func TestReportLocalOverride(t *testing.T) {
+	previous := config.DefaultConfig
+	t.Cleanup(func() {
+		config.DefaultConfig = previous
+		report = newReport()
+	})
+	config.DefaultConfig = config.Config{Root: t.TempDir()}
+	config.DefaultConfig.VersionOverrides.Agent = "file:///build/kairos-agent"
+	report = newReport()
+	l := logger.NewKairosLogger("test", "error", true)
+
+	report.addActions(GetInstallKairosBinariesActions(values.System{Distro: values.Ubuntu, Arch: values.ArchAMD64}, l))
+	for _, b := range report.Binaries {
+		if b.Name == "kairos-agent" {
+			if b.Source != "/build/kairos-agent" {
+				t.Errorf("expected the local path as the source of the agent, got %+v", b)
+			}
+			return
+		}
+	}
+	t.Errorf("expected the locally overridden agent in the report, got %+v", report.Binaries)
+}
@@ -0,0 +1,149 @@
+package stages
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	yiplogger "github.com/mudler/yip/pkg/logger"
+	"github.com/mudler/yip/pkg/plugins"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// newExecutor returns the yip executor for the target system
+// When working on a root, the os conditionals are checked against the os-release of the root instead of the running system
+func newExecutor(l logger.KairosLogger) executor.Executor {
+	if !config.HasRoot() {
+		return executor.NewExecutor(executor.WithLogger(l))
+	}
+	return executor.NewExecutor(
+		executor.WithLogger(l),
+		executor.WithConditionals(
+			plugins.NodeConditional,
+			plugins.IfConditional,
+			onlyIfRootOS,
+			onlyIfRootOSVersion,
+			plugins.IfArch,
+			plugins.IfServiceManager,
+			plugins.IfFiles,
+		),
+	)
+}
+
+// newConsole returns the yip console for the target system
+// When working on a root, commands are run chrooted into it
+func newConsole(l logger.KairosLogger) plugins.Console {
+	c := console.NewStandardConsole(console.WithLogger(l))
+	if !config.HasRoot() {
+		return c
+	}
+	return &rootConsole{console: c, root: config.DefaultConfig.Root}
+}
+
+// rootConsole runs the commands chrooted into root
+// The root needs /proc, /sys and /dev mounted for most package managers to work, same as with any chroot
+type rootConsole struct {
+	console *console.StandardConsole
+	root    string
+}
+
+func (c *rootConsole) Run(cmd string, opts ...func(*exec.Cmd)) (string, error) {
+	return c.console.Run(cmd, append(opts, c.chroot)...)
+}
+
+func (c *rootConsole) Start(cmd *exec.Cmd, opts ...func(*exec.Cmd)) error {
+	return c.console.Start(cmd, append(opts, c.chroot)...)
+}
+
+func (c *rootConsole) RunTemplate(st []string, template string) error {
+	var errs error
+	for _, svc := range st {
+		if _, err := c.Run(fmt.Sprintf(template, svc)); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// chroot sets the command to run inside the root
+// The binary is looked up again inside the root as exec.Command resolves it against the running system
+func (c *rootConsole) chroot(cmd *exec.Cmd) {
+	if len(cmd.Args) > 0 && !filepath.IsAbs(cmd.Args[0]) {
+		if path, err := system.LookPath(c.root, cmd.Args[0], filepath.SplitList(system.DefaultPath)); err == nil {
+			cmd.Path = path
+			cmd.Err = nil
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = c.root
+	cmd.Dir = "/"
+}
+
+// rootOSRelease reads the name and version of the target system from its os-release in the same way yip does for the
+// running system
+func rootOSRelease(fs vfs.FS) (name string, version string, err error) {
+	data, err := fs.ReadFile("/etc/os-release")
+	if err != nil {
+		return "", "", err
+	}
+	vals, err := godotenv.UnmarshalBytes(data)
+	if err != nil {
+		return "", "", err
+	}
+	version = vals["VERSION_ID"]
+	// yip only uses the major version for these
+	switch vals["ID"] {
+	case "almalinux", "rocky":
+		version = strings.Split(version, ".")[0]
+	}
+	return vals["PRETTY_NAME"], version, nil
+}
+
+// onlyIfRootOS is plugins.OnlyIfOS for the target system
+func onlyIfRootOS(l yiplogger.Interface, s schema.Stage, fs vfs.FS, _ plugins.Console) error {
+	if s.OnlyIfOs == "" {
+		return nil
+	}
+	name, _, err := rootOSRelease(fs)
+	if err != nil || name == "" {
+		return fmt.Errorf("%s as system os name is empty", fmt.Sprintf(plugins.SkipOnlyOs, s.OnlyIfOs))
+	}
+	return matchOSRegex(l, s.OnlyIfOs, name, plugins.SkipOnlyOs, plugins.RunOnlyOs)
+}
+
+// onlyIfRootOSVersion is plugins.OnlyIfOSVersion for the target system
+func onlyIfRootOSVersion(l yiplogger.Interface, s schema.Stage, fs vfs.FS, _ plugins.Console) error {
+	if s.OnlyIfOsVersion == "" {
+		return nil
+	}
+	_, version, err := rootOSRelease(fs)
+	if err != nil || version == "" {
+		return fmt.Errorf("%s as system version is empty", fmt.Sprintf(plugins.SkipOnlyOsVersion, s.OnlyIfOsVersion))
+	}
+	return matchOSRegex(l, s.OnlyIfOsVersion, version, plugins.SkipOnlyOsVersion, plugins.RunOnlyOsVersion)
+}
+
+func matchOSRegex(l yiplogger.Interface, expr, value, skipMsg, runMsg string) error {
+	compile, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	if compile.MatchString(value) {
+		l.Debugf("%s matches '%s'", fmt.Sprintf(runMsg, expr), value)
+		return nil
+	}
+	return fmt.Errorf("%s doesn't match %s", fmt.Sprintf(skipMsg, expr), value)
+}
@@ -0,0 +1,531 @@
+package stages
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/constants"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+// sbomPackage is a component of the system, either a package of the distro or a binary installed by kairos-init
+type sbomPackage struct {
+	name    string
+	version string
+	purl    string
+	path    string        // Only for binaries
+	modules []sbomPackage // Go modules a binary is built from
+}
+
+// sbomBinaries are the binaries that kairos-init installs, by their name in the version-info.yaml of the bundled
+// binaries. The installer is not versioned there, its version comes from the Go build info.
+var sbomBinaries = []struct {
+	name     string
+	path     string
+	override func(config.VersionOverrides) string
+}{
+	{"kairos-agent", constants.AgentDefaultPath, func(o config.VersionOverrides) string { return o.Agent }},
+	{"immucore", "/usr/bin/immucore", func(o config.VersionOverrides) string { return o.Immucore }},
+	{"kcrypt-discovery-challenger", "/system/discovery/kcrypt-discovery-challenger", func(o config.VersionOverrides) string { return o.KcryptChallenger }},
+	{"provider-kairos", "/system/providers/agent-provider-kairos", func(o config.VersionOverrides) string { return o.Provider }},
+	{"edgevpn", "/usr/bin/edgevpn", func(o config.VersionOverrides) string { return o.EdgeVpn }},
+	{"kairos-installer", constants.InstallerDefaultPath, func(config.VersionOverrides) string { return "" }},
+}
+
+// GetSBOMActions returns the actions that write the SBOM of the system into the target system and the host path
+// The SBOM is generated once and written to both places, so they are the same document
+func GetSBOMActions(sis values.System, l logger.KairosLogger) []Action {
+	sbom := config.DefaultConfig.SBOM
+	generate := sync.OnceValues(func() ([]byte, error) {
+		return GenerateSBOM(sis, sbom.Format, l)
+	})
+
+	var actions []Action
+	if sbom.Path != "" {
+		actions = append(actions, Action{
+			Step:   values.SBOMStep,
+			Kind:   ActionSBOM,
+			Source: sbom.Format,
+			Dest:   sbom.Path,
+			apply: func(l logger.KairosLogger) error {
+				return writeSBOM(generate, config.RootPath(sbom.Path), l)
+			},
+		})
+	}
+	if sbom.HostPath != "" {
+		actions = append(actions, Action{
+			Step:   values.SBOMStep,
+			Kind:   ActionSBOMHost,
+			Source: sbom.Format,
+			Dest:   sbom.HostPath,
+			apply: func(l logger.KairosLogger) error {
+				return writeSBOM(generate, sbom.HostPath, l)
+			},
+		})
+	}
+	return actions
+}
+
+func writeSBOM(generate func() ([]byte, error), path string, l logger.KairosLogger) error {
+	data, err := generate()
+	if err != nil {
+		l.Logger.Error().Err(err).Msg("Failed to generate the SBOM")
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		l.Logger.Error().Err(err).Str("dir", filepath.Dir(path)).Msg("Failed to create directory")
+		return err
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		l.Logger.Error().Err(err).Str("path", path).Msg("Failed to write the SBOM")
+		return err
+	}
+	l.Logger.Info().Str("path", path).Msg("Wrote the SBOM")
+	return nil
+}
+
+// GenerateSBOM returns the SBOM of the target system in the given format, with the packages in its package database
+// and the kairos binaries found in it
+func GenerateSBOM(sis values.System, format string, l logger.KairosLogger) ([]byte, error) {
+	packages, err := installedPackages(sis, l)
+	if err != nil {
+		return nil, err
+	}
+	binaries := installedBinaries(l)
+	l.Logger.Debug().Int("packages", len(packages)).Int("binaries", len(binaries)).Str("format", format).Msg("Generating the SBOM")
+
+	switch format {
+	case config.SBOMSPDX:
+		return json.MarshalIndent(spdxSBOM(sis, packages, binaries), "", "  ")
+	case config.SBOMCycloneDX:
+		return json.MarshalIndent(cycloneDXSBOM(sis, packages, binaries), "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown SBOM format %s, valid formats are %s", format, strings.Join(config.SBOMFormats, ", "))
+	}
+}
+
+// installedPackages reads the packages from the package database of the target system
+// dpkg, apk and pacman databases are plain files, the rpm one (used by dnf and zypper) is queried with rpm itself
+func installedPackages(sis values.System, l logger.KairosLogger) ([]sbomPackage, error) {
+	readers := []struct {
+		path  string
+		parse func(io.Reader, values.System) []sbomPackage
+	}{
+		{"/var/lib/dpkg/status", parseDpkgStatus},
+		{"/lib/apk/db/installed", parseApkInstalled},
+	}
+	for _, r := range readers {
+		data, err := os.ReadFile(config.RootPath(r.path))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		l.Logger.Debug().Str("db", r.path).Msg("Reading the installed packages")
+		return r.parse(bytes.NewReader(data), sis), nil
+	}
+
+	if dirs, err := filepath.Glob(config.RootPath("/var/lib/pacman/local/*/desc")); err == nil && len(dirs) > 0 {
+		l.Logger.Debug().Str("db", "/var/lib/pacman/local").Msg("Reading the installed packages")
+		var packages []sbomPackage
+		for _, desc := range dirs {
+			data, err := os.ReadFile(desc)
+			if err != nil {
+				return nil, err
+			}
+			if p, ok := parsePacmanDesc(bytes.NewReader(data), sis); ok {
+				packages = append(packages, p)
+			}
+		}
+		return packages, nil
+	}
+
+	if _, err := system.LookPath(config.RootPath("/"), "rpm", filepath.SplitList(system.DefaultPath)); err == nil {
+		l.Logger.Debug().Str("db", "rpm").Msg("Reading the installed packages")
+		out, err := newConsole(l).Run(`rpm -qa --queryformat '%{NAME}\t%{EPOCH}\t%{VERSION}-%{RELEASE}\t%{ARCH}\n'`)
+		if err != nil {
+			l.Logger.Error().Err(err).Str("output", out).Msg("Failed to query the rpm database")
+			return nil, err
+		}
+		return parseRpmQuery(out, sis), nil
+	}
+
+	l.Logger.Warn().Msg("No package database found, the SBOM only has the kairos binaries")
+	return nil, nil
+}
+
+// parseDpkgStatus reads the installed packages of a dpkg status file
+func parseDpkgStatus(r io.Reader, sis values.System) []sbomPackage {
+	var packages []sbomPackage
+	for _, fields := range controlParagraphs(r) {
+		status := strings.Fields(fields["Status"])
+		if len(status) != 3 || status[2] != "installed" {
+			continue
+		}
+		packages = append(packages, osPackage("deb", fields["Package"], fields["Version"], fields["Architecture"], "", sis))
+	}
+	return packages
+}
+
+// parseApkInstalled reads the installed packages of the apk database
+func parseApkInstalled(r io.Reader, sis values.System) []sbomPackage {
+	var packages []sbomPackage
+	for _, fields := range controlParagraphs(r) {
+		if fields["P"] == "" {
+			continue
+		}
+		packages = append(packages, osPackage("apk", fields["P"], fields["V"], fields["A"], "", sis))
+	}
+	return packages
+}
+
+// parsePacmanDesc reads the installed package of a desc file of the pacman database
+// The fields are a %NAME% line followed by the values until an empty line
+func parsePacmanDesc(r io.Reader, sis values.System) (sbomPackage, bool) {
+	fields := map[string]string{}
+	key := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			key = ""
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			key = strings.Trim(line, "%")
+		case key != "" && fields[key] == "":
+			fields[key] = line
+		}
+	}
+	if fields["NAME"] == "" {
+		return sbomPackage{}, false
+	}
+	return osPackage("alpm", fields["NAME"], fields["VERSION"], fields["ARCH"], "", sis), true
+}
+
+// parseRpmQuery reads the installed packages from the output of the rpm query
+// Lines that are not packages, like warnings of rpm, are ignored
+func parseRpmQuery(out string, sis values.System) []sbomPackage {
+	var packages []sbomPackage
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		// gpg-pubkey are the keys imported into the rpm database, not packages
+		if len(fields) != 4 || fields[0] == "" || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		epoch := fields[1]
+		if epoch == "(none)" {
+			epoch = ""
+		}
+		packages = append(packages, osPackage("rpm", fields[0], fields[2], fields[3], epoch, sis))
+	}
+	return packages
+}
+
+// controlParagraphs splits the key value paragraphs of a dpkg or apk database, continuation lines are ignored
+func controlParagraphs(r io.Reader) []map[string]string {
+	var paragraphs []map[string]string
+	current := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, current)
+				current = map[string]string{}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if key, value, found := strings.Cut(line, ":"); found {
+			current[key] = strings.TrimSpace(value)
+		}
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, current)
+	}
+	return paragraphs
+}
+
+// osPackage returns a package of the distro with its purl
+func osPackage(purlType, name, version, arch, epoch string, sis values.System) sbomPackage {
+	qualifiers := url.Values{}
+	if arch != "" {
+		qualifiers.Set("arch", arch)
+	}
+	if epoch != "" {
+		qualifiers.Set("epoch", epoch)
+	}
+	distro := string(sis.Distro)
+	if sis.Version != "" {
+		qualifiers.Set("distro", fmt.Sprintf("%s-%s", distro, sis.Version))
+	}
+	return sbomPackage{name: name, version: version, purl: purl(purlType, distro, name, version, qualifiers)}
+}
+
+// purl returns the package url of a package, see https://github.com/package-url/purl-spec
+func purl(purlType, namespace, name, version string, qualifiers url.Values) string {
+	p := "pkg:" + purlType + "/"
+	if namespace != "" {
+		p += escapePurl(namespace) + "/"
+	}
+	p += escapePurl(name)
+	if version != "" {
+		p += "@" + url.PathEscape(version)
+	}
+	if len(qualifiers) > 0 {
+		p += "?" + qualifiers.Encode()
+	}
+	return p
+}
+
+// escapePurl escapes each segment of a namespace or name, keeping the slashes between them
+func escapePurl(s string) string {
+	segments := strings.Split(s, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// installedBinaries returns the kairos binaries found in the target system with the Go modules they are built from
+// The version is the overridden one if it's a release version, the one of the bundled binaries if not overridden, or
+// the one in the Go build info otherwise
+func installedBinaries(l logger.KairosLogger) []sbomPackage {
+	var binaries []sbomPackage
+	for _, b := range sbomBinaries {
+		if !exists(b.path) {
+			continue
+		}
+		override := b.override(config.DefaultConfig.VersionOverrides)
+		p := sbomPackage{name: b.name, path: b.path, version: overrideVersion(override)}
+		if override == "" {
+			p.version = embeddedVersions()[b.name]
+		}
+		info, err := buildinfo.ReadFile(config.RootPath(b.path))
+		if err != nil {
+			l.Logger.Warn().Err(err).Str("binary", b.path).Msg("Failed to read the Go build info, the SBOM won't have its modules")
+		} else {
+			if p.version == "" && info.Main.Version != "(devel)" {
+				p.version = info.Main.Version
+			}
+			for _, dep := range info.Deps {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				p.modules = append(p.modules, sbomPackage{name: dep.Path, version: dep.Version, purl: purl("golang", "", dep.Path, dep.Version, nil)})
+			}
+		}
+		p.purl = purl("github", "kairos-io", b.name, p.version, nil)
+		if b.name == "edgevpn" {
+			p.purl = purl("github", "mudler", b.name, p.version, nil)
+		}
+		binaries = append(binaries, p)
+	}
+	return binaries
+}
+
+// spdxDocument is an SPDX 2.3 document, see https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxInvalidID matches the characters not allowed in an SPDX id
+var spdxInvalidID = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+func spdxSBOM(sis values.System, packages, binaries []sbomPackage) spdxDocument {
+	name := sbomName(sis)
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://kairos.io/spdx/%s-%s", spdxInvalidID.ReplaceAllString(name, "-"), newUUID()),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: kairos-init-" + values.GetVersion()},
+		},
+	}
+
+	ids := map[string]string{} // By purl, so the Go modules shared by the binaries are listed once
+	add := func(p sbomPackage, purpose, comment string) string {
+		if id, ok := ids[p.purl]; ok && p.purl != "" {
+			return id
+		}
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", spdxInvalidID.ReplaceAllString(p.name, "-"), len(doc.Packages))
+		sp := spdxPackage{Name: p.name, SPDXID: id, VersionInfo: p.version, DownloadLocation: "NOASSERTION", PrimaryPackagePurpose: purpose, Comment: comment}
+		if p.purl != "" {
+			sp.ExternalRefs = []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: p.purl}}
+			ids[p.purl] = id
+		}
+		doc.Packages = append(doc.Packages, sp)
+		return id
+	}
+	relate := func(from, kind, to string) {
+		doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: from, RelationshipType: kind, RelatedSPDXElement: to})
+	}
+
+	root := add(sbomPackage{name: string(sis.Distro), version: sis.Version}, "OPERATING-SYSTEM", "")
+	relate(doc.SPDXID, "DESCRIBES", root)
+	for _, p := range packages {
+		relate(root, "CONTAINS", add(p, "LIBRARY", ""))
+	}
+	for _, b := range binaries {
+		id := add(b, "APPLICATION", "Installed by kairos-init at "+b.path)
+		relate(root, "CONTAINS", id)
+		for _, m := range b.modules {
+			relate(id, "DEPENDS_ON", add(m, "LIBRARY", ""))
+		}
+	}
+	return doc
+}
+
+// cycloneDXDocument is a CycloneDX 1.5 document, see https://cyclonedx.org/docs/1.5/json/
+type cycloneDXDocument struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	SerialNumber string                `json:"serialNumber"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies,omitempty"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string               `json:"timestamp"`
+	Tools     []cycloneDXComponent `json:"tools"`
+	Component cycloneDXComponent   `json:"component"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Purl       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+func cycloneDXSBOM(sis values.System, packages, binaries []sbomPackage) cycloneDXDocument {
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []cycloneDXComponent{{Type: "application", Name: "kairos-init", Version: values.GetVersion()}},
+			Component: cycloneDXComponent{Type: "operating-system", BOMRef: "system", Name: string(sis.Distro), Version: sis.Version},
+		},
+	}
+
+	refs := map[string]bool{}
+	add := func(p sbomPackage, kind string, props ...cycloneDXProperty) string {
+		ref := p.purl
+		if ref == "" {
+			ref = p.name
+		}
+		if !refs[ref] {
+			refs[ref] = true
+			doc.Components = append(doc.Components, cycloneDXComponent{Type: kind, BOMRef: ref, Name: p.name, Version: p.version, Purl: p.purl, Properties: props})
+		}
+		return ref
+	}
+
+	root := cycloneDXDependency{Ref: doc.Metadata.Component.BOMRef}
+	for _, p := range packages {
+		root.DependsOn = append(root.DependsOn, add(p, "library"))
+	}
+	var deps []cycloneDXDependency
+	for _, b := range binaries {
+		ref := add(b, "application", cycloneDXProperty{Name: "kairos-init:path", Value: b.path})
+		root.DependsOn = append(root.DependsOn, ref)
+		dep := cycloneDXDependency{Ref: ref}
+		for _, m := range b.modules {
+			dep.DependsOn = append(dep.DependsOn, add(m, "library"))
+		}
+		deps = append(deps, dep)
+	}
+	sort.Strings(root.DependsOn)
+	doc.Dependencies = append([]cycloneDXDependency{root}, deps...)
+	return doc
+}
+
+// sbomName is the name of the system in the SBOM
+func sbomName(sis values.System) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", sis.Distro, sis.Version))
+}
+
+// newUUID returns a random UUID, as the SBOM documents need a unique id
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
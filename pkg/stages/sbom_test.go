@@ -0,0 +1,146 @@
+package stages
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+const dpkgStatus = `Package: curl
+Status: install ok installed
+Priority: optional
+Architecture: amd64
+Version: 8.5.0-2ubuntu10
+Description: command line tool for transferring data with URL syntax
+ curl is a command line tool for transferring data with URL syntax.
+
+Package: nano
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 7.2-2
+
+Package: tzdata
+Status: install ok installed
+Architecture: all
+Version: 1:2024a-2
+`
+
+func TestSBOMPackageDatabases(t *testing.T) {
+	sis := values.System{Distro: values.Ubuntu, Version: "24.04"}
+	pkgs := parseDpkgStatus(strings.NewReader(dpkgStatus), sis)
+	if len(pkgs) != 2 {
+		t.Fatalf("expected only the installed packages, got %v", pkgs)
+	}
+	if pkgs[0].purl != "pkg:deb/ubuntu/curl@8.5.0-2ubuntu10?arch=amd64&distro=ubuntu-24.04" {
+		t.Errorf("unexpected purl %s", pkgs[0].purl)
+	}
+	if pkgs[1].name != "tzdata" || pkgs[1].version != "1:2024a-2" {
+		t.Errorf("unexpected package %v", pkgs[1])
+	}
+
+	sis = values.System{Distro: values.Alpine, Version: "3.21.0"}
+	pkgs = parseApkInstalled(strings.NewReader("C:Q1abc=\nP:busybox\nV:1.37.0-r8\nA:x86_64\n\nC:Q1def=\nP:musl\nV:1.2.5-r8\nA:x86_64\n"), sis)
+	if len(pkgs) != 2 || pkgs[1].purl != "pkg:apk/alpine/musl@1.2.5-r8?arch=x86_64&distro=alpine-3.21.0" {
+		t.Errorf("unexpected apk packages %v", pkgs)
+	}
+
+	p, ok := parsePacmanDesc(strings.NewReader("%NAME%\nlinux\n\n%VERSION%\n6.12.1.arch1-1\n\n%ARCH%\nx86_64\n"), values.System{Distro: values.Arch})
+	if !ok || p.purl != "pkg:alpm/arch/linux@6.12.1.arch1-1?arch=x86_64" {
+		t.Errorf("unexpected pacman package %v", p)
+	}
+
+	sis = values.System{Distro: values.RockyLinux, Version: "9.5"}
+	pkgs = parseRpmQuery("warning: something\nbash\t(none)\t5.1.8-9.el9\tx86_64\ngpg-pubkey\t(none)\t350d275d-6279464b\t(none)\nopenssl\t1\t3.2.2-6.el9_5\tx86_64\n", sis)
+	if len(pkgs) != 2 {
+		t.Fatalf("expected the rpm packages without the keys, got %v", pkgs)
+	}
+	if pkgs[1].purl != "pkg:rpm/rocky/openssl@3.2.2-6.el9_5?arch=x86_64&distro=rocky-9.5&epoch=1" {
+		t.Errorf("unexpected purl %s", pkgs[1].purl)
+	}
+}
+
+func TestGenerateSBOM(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	root := t.TempDir()
+	config.DefaultConfig.Root = root
+
+	if err := os.MkdirAll(filepath.Join(root, "var/lib/dpkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "var/lib/dpkg/status"), []byte(dpkgStatus), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The test binary is a Go binary, so it has build info like the kairos ones
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(root, "usr/bin/immucore"), data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultConfig.VersionOverrides.Immucore = "v0.9.0"
+
+	l := logger.NewKairosLogger("test", "error", false)
+	sis := values.System{Distro: values.Ubuntu, Version: "24.04", Arch: values.ArchAMD64}
+
+	out, err := GenerateSBOM(sis, config.SBOMSPDX, l)
+	if err != nil {
+		t.Fatalf("GenerateSBOM: %v", err)
+	}
+	var spdx spdxDocument
+	if err = json.Unmarshal(out, &spdx); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, p := range spdx.Packages {
+		found[p.Name] = p.VersionInfo
+	}
+	if found["curl"] != "8.5.0-2ubuntu10" || found["immucore"] != "v0.9.0" {
+		t.Errorf("expected the packages and binaries in the SPDX document, got %v", found)
+	}
+	if found["ubuntu"] != "24.04" || spdx.Relationships[0].RelationshipType != "DESCRIBES" {
+		t.Errorf("expected the document to describe the system, got %v", spdx.Relationships[0])
+	}
+	dependsOn := 0
+	for _, r := range spdx.Relationships {
+		if r.RelationshipType == "DEPENDS_ON" {
+			dependsOn++
+		}
+	}
+	if dependsOn == 0 {
+		t.Errorf("expected the Go modules of the binaries in the SPDX document")
+	}
+
+	out, err = GenerateSBOM(sis, config.SBOMCycloneDX, l)
+	if err != nil {
+		t.Fatalf("GenerateSBOM: %v", err)
+	}
+	var cdx cycloneDXDocument
+	if err = json.Unmarshal(out, &cdx); err != nil {
+		t.Fatal(err)
+	}
+	if cdx.BOMFormat != "CycloneDX" || cdx.Metadata.Component.Name != "ubuntu" {
+		t.Errorf("unexpected CycloneDX document %v", cdx.Metadata)
+	}
+	if len(cdx.Dependencies) != 2 || len(cdx.Dependencies[0].DependsOn) != 3 {
+		t.Errorf("expected the system to depend on the packages and the binary, got %v", cdx.Dependencies)
+	}
+
+	if _, err = GenerateSBOM(sis, "swid", l); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
@@ -1,16 +1,30 @@
 package stages
 
 import (
+	"time"
+
+	"github.com/hashicorp/go-multierror"
 	"github.com/kairos-io/kairos-init/pkg/config"
 	"github.com/kairos-io/kairos-init/pkg/system"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types/logger"
-	"github.com/mudler/yip/pkg/console"
-	"github.com/mudler/yip/pkg/executor"
 	"github.com/mudler/yip/pkg/schema"
-	"github.com/twpayne/go-vfs/v5"
 )
 
+// The yip stages that are run for each kairos-init stage, in order
+var (
+	installPhases = []string{"before-install", "install", "after-install"}
+	initPhases    = []string{"before-init", "init", "after-init"}
+)
+
+// stagePhases returns the yip stages that are run for the given kairos-init stage
+func stagePhases(stage string) []string {
+	if stage == values.InstallStage {
+		return installPhases
+	}
+	return initPhases
+}
+
 // RunAllStages Runs all the stages in the correct order
 func RunAllStages(logger logger.KairosLogger) (schema.YipConfig, error) {
 	fullYipConfig := schema.YipConfig{Stages: map[string][]schema.Stage{}}
@@ -45,95 +59,25 @@ func RunAllStages(logger logger.KairosLogger) (schema.YipConfig, error) {
 func RunInstallStage(logger logger.KairosLogger) (schema.YipConfig, error) {
 	if config.ContainsSkipStep(values.InstallStage) {
 		logger.Logger.Warn().Msg("Skipping install stage as per configuration")
+		report.stageSkipped(values.InstallStage)
 		return schema.YipConfig{Stages: map[string][]schema.Stage{}}, nil
 	}
 	logger.Info("Running stage install")
-	sis := system.DetectSystem(logger)
-	initExecutor := executor.NewExecutor(executor.WithLogger(logger))
-	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
-
-	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
-	// Run things before we install packages
-
-	// Initialize the "before-install" stage; it will be populated with model-specific repo tweaks and extensions
-	data.Stages["before-install"] = []schema.Stage{}
-
-	// On Rpi3 and Rpi4 we need to enable the non-free repository for Debian to get the firmware
-	if config.DefaultConfig.Model == values.Rpi3.String() || config.DefaultConfig.Model == values.Rpi4.String() {
-		data.Stages["before-install"] = append(data.Stages["before-install"], []schema.Stage{
-			{
-				Name:     "Enable non-free repository",
-				OnlyIfOs: "Debian.*",
-				Commands: []string{
-					"sed -i 's/^Components: main.*$/& non-free-firmware/' /etc/apt/sources.list.d/debian.sources",
-				},
-			},
-		}...)
-	}
-	// Add extensions from disk
-	data.Stages["before-install"] = append(data.Stages["before-install"], GetStageExtensions("before-install", logger)...)
-
-	// Add packages install
-	installStage, err := GetInstallStage(sis, logger)
-	if err != nil {
-		logger.Logger.Error().Msgf("Failed to get the install stage: %s", err)
-		return data, err
-	}
-	data.Stages["install"] = installStage
-
-	// Get kernel stage
-	kernelStage, err := GetInstallKernelStage(sis, logger)
-	if err != nil {
-		logger.Logger.Error().Msgf("Failed to get the kernel stage: %s", err)
-		return data, err
-	}
-	data.Stages["install"] = append(data.Stages["install"], kernelStage...)
-	// Add the branding files
-	data.Stages["install"] = append(data.Stages["install"], GetInstallBrandingStage(sis, logger)...)
-	// Add the bootargs file
-	data.Stages["install"] = append(data.Stages["install"], GetInstallGrubBootArgsStage(sis, logger)...)
-	// Add the miscellaneous files
-	data.Stages["install"] = append(data.Stages["install"], GetKairosMiscellaneousFilesStage(sis, logger)...)
-	// Add extensions from disk
-	data.Stages["install"] = append(data.Stages["install"], GetStageExtensions("install", logger)...)
-	// Run things after we install packages and framework
-	data.Stages["after-install"] = []schema.Stage{}
-	// Add extensions from disk
-	data.Stages["after-install"] = append(data.Stages["after-install"], GetStageExtensions("after-install", logger)...)
-
-	for _, st := range []string{"before-install", "install", "after-install"} {
-		err = initExecutor.Run(st, vfs.OSFS, yipConsole, data.ToString())
-		if err != nil {
-			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
-			return data, err
-		}
-	}
-
-	// Copy the configs in the system
-	err = GetInstallOemCloudConfigs(logger)
-	if err != nil {
-		return schema.YipConfig{}, err
-	}
-
-	// Bring kairos binaries
-	err = GetInstallKairosBinaries(sis, logger)
-	if err != nil {
-		return schema.YipConfig{}, err
-	}
+	sis := system.DetectSystem(config.RootPath("/"), logger)
+	report.setSystem(sis)
 
-	// Bring provider binaries
-	err = GetInstallProviderBinaries(sis, logger)
+	plan, err := BuildInstallStage(sis, logger)
 	if err != nil {
-		return schema.YipConfig{}, err
+		return plan.YipConfig(), err
 	}
 
-	// Trigger the build install event for providers
-	err = ProviderBuildInstallEvent(sis, logger)
-	if err != nil {
-		return schema.YipConfig{}, err
-	}
+	err = runPlan(plan, installPhases, logger)
+	return plan.YipConfig(), err
+}
 
-	return data, nil
+// BuildInstallStage builds the install stage for the given system without running anything
+func BuildInstallStage(sis values.System, logger logger.KairosLogger) (Plan, error) {
+	return buildStage(values.InstallStage, installPhases, sis, logger)
 }
 
 // RunInitStage Runs the init stage
@@ -142,65 +86,101 @@ func RunInstallStage(logger logger.KairosLogger) (schema.YipConfig, error) {
 func RunInitStage(logger logger.KairosLogger) (schema.YipConfig, error) {
 	if config.ContainsSkipStep(values.InitStage) {
 		logger.Logger.Warn().Msg("Skipping init stage as per configuration")
+		report.stageSkipped(values.InitStage)
 		return schema.YipConfig{Stages: map[string][]schema.Stage{}}, nil
 	}
 	logger.Info("Running stage init")
-	sis := system.DetectSystem(logger)
-	initExecutor := executor.NewExecutor(executor.WithLogger(logger))
-	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
+	sis := system.DetectSystem(config.RootPath("/"), logger)
+	report.setSystem(sis)
 
-	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
+	plan, err := BuildInitStage(sis, logger)
+	if err != nil {
+		return plan.YipConfig(), err
+	}
 
-	// Run things before we init the system
-	data.Stages["before-init"] = []schema.Stage{}
+	err = runPlan(plan, initPhases, logger)
+	return plan.YipConfig(), err
+}
 
-	// Add extensions from disk
-	data.Stages["before-init"] = append(data.Stages["before-init"], GetStageExtensions("before-init", logger)...)
+// BuildInitStage builds the init stage for the given system without running anything
+func BuildInitStage(sis values.System, logger logger.KairosLogger) (Plan, error) {
+	return buildStage(values.InitStage, initPhases, sis, logger)
+}
 
-	data.Stages["init"] = []schema.Stage{}
-	data.Stages["init"] = append(data.Stages["init"], GetKairosReleaseStage(sis, logger)...)
-	kernelStage, err := GetKernelStage(sis, logger)
-	if err != nil {
-		logger.Logger.Error().Msgf("Failed to get the kernel stage: %s", err)
-		return data, err
+// buildStage builds the registered steps of the stage and adds the extensions from disk at the end of each phase
+func buildStage(stage string, phases []string, sis values.System, logger logger.KairosLogger) (Plan, error) {
+	data := NewPlan()
+	for _, phase := range phases {
+		data.Stages[phase] = []schema.Stage{}
 	}
-	data.Stages["init"] = append(data.Stages["init"], kernelStage...)
 
-	// Add initrd files before rebuilding initrd
-	initrdFilesStage, err := GetKairosInitramfsFilesStage(sis, logger)
+	ext, err := GetExtensions(sis, logger)
 	if err != nil {
 		return data, err
 	}
-	data.Stages["init"] = append(data.Stages["init"], initrdFilesStage...)
 
-	// Rebuild the initrd
-	initrdStage, err := GetInitrdStage(sis, logger)
+	stepsPlan, err := buildSteps(stage, sis, ext, logger)
 	if err != nil {
-		logger.Logger.Error().Msgf("Failed to get the initrd stage: %s", err)
+		logger.Logger.Error().Msgf("Failed to build the %s stage: %s", stage, err)
 		return data, err
 	}
-	data.Stages["init"] = append(data.Stages["init"], initrdStage...)
-	data.Stages["init"] = append(data.Stages["init"], GetServicesStage(sis, logger)...)
-	data.Stages["init"] = append(data.Stages["init"], GetSshHardeningStage(sis, logger)...)
-	data.Stages["init"] = append(data.Stages["init"], GetWorkaroundsStage(sis, logger)...)
-	data.Stages["init"] = append(data.Stages["init"], GetCleanupStage(sis, logger)...)
+	data.Merge(stepsPlan)
 
 	// Add extensions from disk
-	data.Stages["init"] = append(data.Stages["init"], GetStageExtensions("init", logger)...)
-
-	// Run things after we init the system
-	data.Stages["after-init"] = []schema.Stage{}
+	for _, phase := range phases {
+		data.addExtensions(phase, ext[phase])
+	}
 
-	// Add extensions from disk
-	data.Stages["after-init"] = append(data.Stages["after-init"], GetStageExtensions("after-init", logger)...)
+	return data, nil
+}
 
-	for _, st := range []string{"before-init", "init", "after-init"} {
-		err = initExecutor.Run(st, vfs.OSFS, yipConsole, data.ToString())
-		if err != nil {
+// runPlan runs the yip stages of the plan for the given phases in order and then applies the plan actions
+// Each step is run on its own so its completion can be recorded, the extensions run after the steps of each phase.
+// A failing step doesn't stop the rest of the steps of the phase, same as with a failing yip stage, but the next
+// phases are not run.
+func runPlan(plan Plan, phases []string, logger logger.KairosLogger) error {
+	initExecutor := newExecutor(logger)
+	yipConsole := newConsole(logger)
+	report.stagePending(plan)
+	tracker, err := newStepTracker(plan, phases, logger)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("Failed to load the steps state")
+		return err
+	}
+
+	for _, st := range phases {
+		var errs *multierror.Error
+		for _, sp := range plan.steps {
+			if tracker.skip[sp.name] || len(sp.plan.Stages[st]) == 0 {
+				continue
+			}
+			yipConfig := schema.YipConfig{Stages: map[string][]schema.Stage{st: sp.plan.Stages[st]}}
+			start := time.Now()
+			err = initExecutor.Run(st, config.RootFS(), yipConsole, yipConfig.ToString())
+			tracker.done(sp.name, time.Since(start), err)
+			errs = multierror.Append(errs, err)
+		}
+		if len(plan.extensions[st]) > 0 {
+			yipConfig := schema.YipConfig{Stages: map[string][]schema.Stage{st: plan.extensions[st]}}
+			errs = multierror.Append(errs, initExecutor.Run(st, config.RootFS(), yipConsole, yipConfig.ToString()))
+		}
+		if err = errs.ErrorOrNil(); err != nil {
 			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
-			return data, err
+			return err
 		}
 	}
 
-	return data, nil
+	for _, sp := range plan.steps {
+		if tracker.skip[sp.name] || len(sp.plan.Actions) == 0 {
+			continue
+		}
+		start := time.Now()
+		err = applyActions(sp.plan.Actions, logger)
+		tracker.done(sp.name, time.Since(start), err)
+		if err != nil {
+			return err
+		}
+		report.addActions(sp.plan.Actions)
+	}
+	return nil
 }
@@ -0,0 +1,227 @@
+package stages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// StateFile is where the completed steps are recorded in the target system
+const StateFile = "/etc/kairos/kairos-init-state.yaml"
+
+// State is the record of the steps that completed successfully
+type State struct {
+	Steps map[string]StepState `yaml:"steps"`
+}
+
+// StepState is the record of a completed step
+// The hash covers everything the step was going to do, so any change in the inputs (config, versions, detected system)
+// that changes the step also changes the hash. It also covers the hash of the step run before it, so a change in an
+// earlier step invalidates all the ones after it.
+type StepState struct {
+	Hash      string    `yaml:"hash"`
+	Completed time.Time `yaml:"completed"`
+}
+
+// LoadState reads the state of the target system, a missing file is an empty state
+func LoadState() (State, error) {
+	state := State{Steps: map[string]StepState{}}
+	data, err := os.ReadFile(config.RootPath(StateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err = yaml.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.Steps == nil {
+		state.Steps = map[string]StepState{}
+	}
+	return state, nil
+}
+
+// Save writes the state into the target system
+func (s State) Save() error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := config.RootPath(StateFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Complete records the step as completed with the given hash
+func (s *State) Complete(name, hash string) {
+	s.Steps[name] = StepState{Hash: hash, Completed: time.Now().UTC()}
+}
+
+// Resumable returns true if the step already completed with the same hash
+func (s State) Resumable(name, hash string) bool {
+	current, ok := s.Steps[name]
+	return ok && current.Hash == hash
+}
+
+// previousHash returns the recorded hash of the closest step run before the given one, so a stage run on its own
+// still chains to the steps of the stages run before it
+func (s State) previousHash(name string) string {
+	previous := ""
+	for _, stage := range stageDescriptions {
+		for _, st := range Steps(stage.Key) {
+			if st.Name() == name {
+				return previous
+			}
+			if recorded, ok := s.Steps[st.Name()]; ok {
+				previous = recorded.Hash
+			}
+		}
+	}
+	return previous
+}
+
+// hash returns the hash of the step plan chained to the previous step hash
+// The kairos-init version is part of it as the embedded files change with it. The packages are hashed as a sorted
+// set, as the order they are installed in doesn't change the result.
+func (sp stepPlan) hash(previous string) (string, error) {
+	data, err := yaml.Marshal(sortedPackages(sp.plan))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(values.GetVersion() + "\n" + previous + "\n" + sp.name + "\n"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sortedPackages returns a copy of the plan with the packages to install and remove of each stage sorted
+func sortedPackages(p Plan) Plan {
+	sorted := p
+	sorted.Stages = map[string][]schema.Stage{}
+	for phase, stages := range p.Stages {
+		sorted.Stages[phase] = slices.Clone(stages)
+		for i := range sorted.Stages[phase] {
+			pkgs := &sorted.Stages[phase][i].Packages
+			pkgs.Install = slices.Sorted(slices.Values(pkgs.Install))
+			pkgs.Remove = slices.Sorted(slices.Values(pkgs.Remove))
+		}
+	}
+	return sorted
+}
+
+// stepTracker keeps the state up to date while a plan runs
+// A step is completed once all its phases and actions ran without errors
+type stepTracker struct {
+	state   State
+	hashes  map[string]string
+	pending map[string]int
+	failed  map[string]bool
+	skip    map[string]bool
+	l       logger.KairosLogger
+}
+
+// newStepTracker loads the state and decides which steps can be skipped when resuming
+// Only the steps at the start of the plan can be skipped, as soon as one has to run all the ones after it run too
+// Steps with nothing to do are not tracked
+func newStepTracker(plan Plan, phases []string, l logger.KairosLogger) (*stepTracker, error) {
+	state, err := LoadState()
+	if err != nil {
+		return nil, err
+	}
+	t := &stepTracker{state: state, hashes: map[string]string{}, pending: map[string]int{}, failed: map[string]bool{}, skip: map[string]bool{}, l: l}
+	resuming := config.DefaultConfig.Resume
+	previous := ""
+	if len(plan.steps) > 0 {
+		previous = state.previousHash(plan.steps[0].name)
+	}
+	invalidated := false
+	for _, sp := range plan.steps {
+		if sp.empty() {
+			report.stepCompleted(sp.name)
+			continue
+		}
+		hash, err := sp.hash(previous)
+		if err != nil {
+			return nil, err
+		}
+		previous = hash
+		t.hashes[sp.name] = hash
+		if resuming && state.Resumable(sp.name, hash) {
+			l.Logger.Info().Str("step", sp.name).Msg("Skipping step as it already completed with the same inputs")
+			t.skip[sp.name] = true
+			report.stepSkipped(sp.name, "already completed with the same inputs")
+			continue
+		}
+		if resuming {
+			l.Logger.Info().Str("step", sp.name).Msg("Resuming from step")
+			resuming = false
+		}
+		// The step runs again, so it's not completed until it finishes
+		if _, ok := state.Steps[sp.name]; ok {
+			delete(state.Steps, sp.name)
+			invalidated = true
+		}
+		for _, phase := range phases {
+			if len(sp.plan.Stages[phase]) > 0 {
+				t.pending[sp.name]++
+			}
+		}
+		if len(sp.plan.Actions) > 0 {
+			t.pending[sp.name]++
+		}
+	}
+	if invalidated {
+		if err = state.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// empty returns true if the step has nothing to do
+func (sp stepPlan) empty() bool {
+	if len(sp.plan.Actions) > 0 {
+		return false
+	}
+	for _, stages := range sp.plan.Stages {
+		if len(stages) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// done marks a part of the step as run and records the step once all its parts ran fine
+func (t *stepTracker) done(name string, d time.Duration, err error) {
+	report.stepRan(name, d, err)
+	if err != nil {
+		t.failed[name] = true
+	}
+	t.pending[name]--
+	if t.pending[name] > 0 || t.failed[name] {
+		return
+	}
+	t.complete(name)
+}
+
+// complete records the step in the state file
+func (t *stepTracker) complete(name string) {
+	report.stepCompleted(name)
+	t.state.Complete(name, t.hashes[name])
+	if err := t.state.Save(); err != nil {
+		t.l.Logger.Warn().Err(err).Str("step", name).Msg("Failed to save the step state")
+	}
+}
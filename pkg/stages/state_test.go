@@ -0,0 +1,126 @@
+package stages
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// writeFilePlan returns a plan for the given steps that writes a file for each one in the install phase
+func writeFilePlan(files map[string]string, fail string) Plan {
+	plan := NewPlan()
+	for _, name := range []string{values.InstallPackagesStep, values.InstallKernelStep} {
+		step := NewPlan()
+		stage := schema.Stage{Name: name, Files: []schema.File{{Path: "/" + name, Content: files[name], Permissions: 0644}}}
+		if name == fail {
+			stage.Commands = []string{"/does-not-exist"}
+		}
+		step.Stages["install"] = []schema.Stage{stage}
+		plan.addStep(name, step)
+	}
+	return plan
+}
+
+func TestResume(t *testing.T) {
+	previous := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = previous })
+	config.DefaultConfig = config.Config{Root: t.TempDir()}
+	l := logger.NewKairosLogger("test", "error", true)
+	files := map[string]string{values.InstallPackagesStep: "packages", values.InstallKernelStep: "kernel"}
+	path := func(name string) string { return filepath.Join(config.DefaultConfig.Root, name) }
+
+	// The second step fails, only the first one is recorded
+	if err := runPlan(writeFilePlan(files, values.InstallKernelStep), installPhases, l); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	state, err := LoadState()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := state.Steps[values.InstallPackagesStep]; !ok || len(state.Steps) != 1 {
+		t.Fatalf("expected only %s to be completed, got %v", values.InstallPackagesStep, state.Steps)
+	}
+
+	// Resuming skips the completed step
+	_ = os.Remove(path(values.InstallPackagesStep))
+	config.DefaultConfig.Resume = true
+	if err = runPlan(writeFilePlan(files, ""), installPhases, l); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = os.Stat(path(values.InstallPackagesStep)); err == nil {
+		t.Errorf("expected %s to be skipped", values.InstallPackagesStep)
+	}
+	if _, err = os.Stat(path(values.InstallKernelStep)); err != nil {
+		t.Errorf("expected %s to run: %v", values.InstallKernelStep, err)
+	}
+
+	// Changing the first step runs all of them again
+	_ = os.Remove(path(values.InstallKernelStep))
+	files[values.InstallPackagesStep] = "other packages"
+	if err = runPlan(writeFilePlan(files, ""), installPhases, l); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{values.InstallPackagesStep, values.InstallKernelStep} {
+		if _, err = os.Stat(path(name)); err != nil {
+			t.Errorf("expected %s to run: %v", name, err)
+		}
+	}
+}
+
+func TestResumeChainsStages(t *testing.T) {
+	state := State{Steps: map[string]StepState{
+		values.InstallPackagesStep: {Hash: "packages"},
+		values.BuildProviderStep:   {Hash: "provider"},
+		values.CleanupStep:         {Hash: "cleanup"},
+	}}
+	if got := state.previousHash(values.KairosReleaseStep); got != "provider" {
+		t.Errorf("expected the init stage to chain to the last install step, got %q", got)
+	}
+	if got := state.previousHash(values.InstallPackagesStep); got != "" {
+		t.Errorf("expected the first step to have no previous hash, got %q", got)
+	}
+}
+
+func TestStepHashIsStable(t *testing.T) {
+	previous := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = previous })
+	config.DefaultConfig = config.Config{Root: t.TempDir(), Model: values.Generic.String()}
+	l := logger.NewKairosLogger("test", "error", true)
+	sis := values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}
+
+	hashes := func() map[string]string {
+		plan, err := BuildInstallStage(sis, l)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		result := map[string]string{}
+		for _, sp := range plan.steps {
+			if result[sp.name], err = sp.hash(""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		return result
+	}
+	first, second := hashes(), hashes()
+	if len(first) == 0 || !maps.Equal(first, second) {
+		t.Errorf("expected the same hashes when planning the same stage twice, got %v and %v", first, second)
+	}
+
+	// The order of the packages doesn't change the hash
+	plan := func(pkgs ...string) stepPlan {
+		p := NewPlan()
+		p.Stages["install"] = []schema.Stage{{Name: "Install base packages", Packages: schema.Packages{Install: pkgs}}}
+		return stepPlan{name: values.InstallPackagesStep, plan: p}
+	}
+	a, _ := plan("nano", "curl", "sudo").hash("")
+	b, _ := plan("sudo", "nano", "curl").hash("")
+	if a != b {
+		t.Errorf("expected the package order not to change the hash, got %s and %s", a, b)
+	}
+}
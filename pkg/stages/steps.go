@@ -0,0 +1,266 @@
+package stages
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// Step is a unit of work of a kairos-init stage that can be skipped by name with --skip-step
+// Steps are run in Order inside their Stage, their Build output is merged into the stage plan
+// What a step Requires must be provided by another step or already be in the system, otherwise the step breaks.
+// What it Wants is not needed for the step to run, but the result is likely not what the user expects without it.
+type Step interface {
+	Name() string
+	Description() string
+	Stage() string // values.InstallStage or values.InitStage
+	Order() int
+	Requires() []Capability
+	Wants() []Capability
+	Provides() []Capability
+	Build(sis values.System, l logger.KairosLogger) (Plan, error)
+}
+
+// BuildFunc builds the plan of a step for the given system
+type BuildFunc func(sis values.System, l logger.KairosLogger) (Plan, error)
+
+// step is the Step implementation used by the built-in steps
+type step struct {
+	name        string
+	description string
+	stage       string
+	order       int
+	requires    []Capability
+	wants       []Capability
+	provides    []Capability
+	build       BuildFunc
+}
+
+// StepOption sets the optional values of a step
+type StepOption func(s *step)
+
+// WithRequires sets the capabilities the step requires
+func WithRequires(caps ...Capability) StepOption {
+	return func(s *step) { s.requires = caps }
+}
+
+// WithWants sets the capabilities the step wants
+func WithWants(caps ...Capability) StepOption {
+	return func(s *step) { s.wants = caps }
+}
+
+// WithProvides sets the capabilities the step provides
+func WithProvides(caps ...Capability) StepOption {
+	return func(s *step) { s.provides = caps }
+}
+
+// NewStep returns a Step with the given values
+func NewStep(name, description, stage string, order int, build BuildFunc, opts ...StepOption) Step {
+	s := step{name: name, description: description, stage: stage, order: order, build: build}
+	for _, o := range opts {
+		o(&s)
+	}
+	return s
+}
+
+func (s step) Name() string           { return s.name }
+func (s step) Description() string    { return s.description }
+func (s step) Stage() string          { return s.stage }
+func (s step) Order() int             { return s.order }
+func (s step) Requires() []Capability { return s.requires }
+func (s step) Wants() []Capability    { return s.wants }
+func (s step) Provides() []Capability { return s.provides }
+func (s step) Build(sis values.System, l logger.KairosLogger) (Plan, error) {
+	return s.build(sis, l)
+}
+
+// stageDescriptions are the descriptions of the stages the steps belong to, in the order they are run
+var stageDescriptions = []values.StepInfo{
+	{Key: values.InstallStage, Value: "The full install stage"},
+	{Key: values.InitStage, Value: "The full init stage"},
+}
+
+var registry []Step
+
+// RegisterStep adds a step to the registry
+// Registering the same step name twice or a step for an unknown stage is a programming error, so it panics
+func RegisterStep(s Step) {
+	if s.Stage() != values.InstallStage && s.Stage() != values.InitStage {
+		panic(fmt.Sprintf("step %s registered for unknown stage %s", s.Name(), s.Stage()))
+	}
+	for _, registered := range registry {
+		if registered.Name() == s.Name() {
+			panic(fmt.Sprintf("step %s registered twice", s.Name()))
+		}
+	}
+	registry = append(registry, s)
+}
+
+// Steps returns the registered steps of the given stage in the order they are run
+func Steps(stage string) []Step {
+	var steps []Step
+	for _, s := range registry {
+		if s.Stage() == stage {
+			steps = append(steps, s)
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Order() < steps[j].Order() })
+	return steps
+}
+
+// GetStep returns the registered step with the given name
+func GetStep(name string) (Step, bool) {
+	for _, s := range registry {
+		if s.Name() == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// StepsInfo returns the stages and their steps with their descriptions, in the order they are run
+// The descriptions include the extension stages that can hook into them
+func StepsInfo() []values.StepInfo {
+	var info []values.StepInfo
+	for _, stage := range stageDescriptions {
+		steps := Steps(stage.Key)
+		names := make([]string, 0, len(steps))
+		for _, s := range steps {
+			names = append(names, s.Name())
+		}
+		info = append(info, values.StepInfo{Key: stage.Key, Value: fmt.Sprintf("%s, which includes the %s steps. Extensions: %s", stage.Value, strings.Join(names, ", "), strings.Join(stagePhases(stage.Key), ", "))})
+		for _, s := range steps {
+			before, after := StepHooks(s.Name())
+			info = append(info, values.StepInfo{Key: s.Name(), Value: fmt.Sprintf("%s. Extensions: %s, %s", s.Description(), before, after)})
+		}
+	}
+	return info
+}
+
+// deprecatedSteps are the step names that can still be skipped but are not steps anymore, with the reason
+var deprecatedSteps = map[string]string{
+	values.KubernetesStep: "the kubernetes provider is installed by the " + values.ProviderBinariesStep + " step",
+}
+
+// DeprecatedStepNames returns the step names that can still be skipped but are not steps anymore
+func DeprecatedStepNames() []string {
+	names := make([]string, 0, len(deprecatedSteps))
+	for name := range deprecatedSteps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeprecatedStep returns why the step name is deprecated, or false if it's not
+func DeprecatedStep(name string) (string, bool) {
+	reason, ok := deprecatedSteps[name]
+	return reason, ok
+}
+
+// GetStepNames returns the names that can be skipped: the stages and all their steps
+func GetStepNames() []string {
+	info := StepsInfo()
+	names := make([]string, 0, len(info))
+	for _, i := range info {
+		names = append(names, i.Key)
+	}
+	return names
+}
+
+// buildSteps builds all the non-skipped steps of the given stage with their extension hooks and merges them into a
+// single plan
+func buildSteps(stage string, sis values.System, ext Extensions, l logger.KairosLogger) (Plan, error) {
+	data := NewPlan()
+	for _, s := range Steps(stage) {
+		if config.ContainsSkipStep(s.Name()) {
+			l.Logger.Warn().Str("step", s.Name()).Msg("Skipping step as per configuration")
+			report.stepSkipped(s.Name(), "skipped as per configuration")
+			continue
+		}
+		stepPlan, err := s.Build(sis, l)
+		if err != nil {
+			l.Logger.Error().Err(err).Str("step", s.Name()).Msg("Failed to build the step")
+			return data, err
+		}
+		data.addStep(s.Name(), addStepHooks(s, stepPlan, ext))
+	}
+	return data, nil
+}
+
+// yipSteps adapts a function returning yip stages to a BuildFunc that adds them to the given phase
+func yipSteps(phase string, f func(values.System, logger.KairosLogger) []schema.Stage) BuildFunc {
+	return func(sis values.System, l logger.KairosLogger) (Plan, error) {
+		data := NewPlan()
+		data.Stages[phase] = f(sis, l)
+		return data, nil
+	}
+}
+
+// yipStepsE is yipSteps for functions that can fail
+func yipStepsE(phase string, f func(values.System, logger.KairosLogger) ([]schema.Stage, error)) BuildFunc {
+	return func(sis values.System, l logger.KairosLogger) (Plan, error) {
+		data := NewPlan()
+		st, err := f(sis, l)
+		data.Stages[phase] = st
+		return data, err
+	}
+}
+
+// actionSteps adapts a function returning actions to a BuildFunc
+func actionSteps(f func(values.System, logger.KairosLogger) []Action) BuildFunc {
+	return func(sis values.System, l logger.KairosLogger) (Plan, error) {
+		data := NewPlan()
+		data.Actions = f(sis, l)
+		return data, nil
+	}
+}
+
+func init() {
+	// Install stage
+	RegisterStep(NewStep(values.InstallPackagesStep, "installs the base system packages", values.InstallStage, 10, buildInstallPackagesStep))
+	RegisterStep(NewStep(values.InstallKernelStep, "installs the kernel packages", values.InstallStage, 20, yipStepsE("install", GetInstallKernelStage),
+		WithProvides(CapKernelPackages)))
+	RegisterStep(NewStep(values.CloudconfigsStep, "installs the cloud-configs for the system", values.InstallStage, 30, func(_ values.System, l logger.KairosLogger) (Plan, error) {
+		data := NewPlan()
+		actions, err := GetInstallOemCloudConfigsActions(l)
+		data.Actions = actions
+		return data, err
+	}))
+	RegisterStep(NewStep(values.BrandingStep, "applies the branding for the system", values.InstallStage, 40, yipSteps("install", GetInstallBrandingStage)))
+	RegisterStep(NewStep(values.GrubStep, "configures the grub bootloader", values.InstallStage, 50, yipSteps("install", GetInstallGrubBootArgsStage)))
+	RegisterStep(NewStep(values.MiscellaneousStep, "applies miscellaneous configurations", values.InstallStage, 60, yipSteps("install", GetKairosMiscellaneousFilesStage)))
+	RegisterStep(NewStep(values.KairosBinariesStep, "installs the kairos binaries", values.InstallStage, 70, actionSteps(GetInstallKairosBinariesActions),
+		WithProvides(CapKairosBinaries)))
+	RegisterStep(NewStep(values.ProviderBinariesStep, "installs the kairos provider binaries for k8s", values.InstallStage, 80, actionSteps(GetInstallProviderBinariesActions)))
+	RegisterStep(NewStep(values.BuildProviderStep, "builds the provider binaries", values.InstallStage, 90, actionSteps(ProviderBuildInstallEventActions)))
+
+	// Init stage
+	RegisterStep(NewStep(values.KairosReleaseStep, "creates and fills the /etc/kairos-release file", values.InitStage, 10, yipSteps("init", GetKairosReleaseStage)))
+	RegisterStep(NewStep(values.KernelStep, "installs the kernel", values.InitStage, 20, yipStepsE("init", GetKernelStage),
+		WithRequires(CapKernelPackages), WithProvides(CapBootKernel)))
+	RegisterStep(NewStep(values.InitramfsConfigsStep, "configures the initramfs for the system", values.InitStage, 30, yipStepsE("init", GetKairosInitramfsFilesStage),
+		WithRequires(CapKairosBinaries), WithProvides(CapInitramfsConfigs)))
+	RegisterStep(NewStep(values.InitrdStep, "generates the initrd", values.InitStage, 40, yipStepsE("init", GetInitrdStage),
+		WithRequires(CapBootKernel), WithWants(CapInitramfsConfigs)))
+	RegisterStep(NewStep(values.ServicesStep, "creates and enables required services", values.InitStage, 50, yipSteps("init", GetServicesStage)))
+	RegisterStep(NewStep(values.SshHardeningStep, "installs the sshd hardening drop-in", values.InitStage, 60, yipSteps("init", GetSshHardeningStage)))
+	RegisterStep(NewStep(values.WorkaroundsStep, "applies workarounds for known issues", values.InitStage, 70, yipSteps("init", GetWorkaroundsStage)))
+	RegisterStep(NewStep(values.CleanupStep, "cleans up the system of unneeded packages and files", values.InitStage, 80, yipSteps("init", GetCleanupStage)))
+	RegisterStep(NewStep(values.SBOMStep, "writes the software bill of materials of the system", values.InitStage, 90, actionSteps(GetSBOMActions)))
+}
+
+// buildInstallPackagesStep sets up the repositories needed before installing the packages and installs them
+func buildInstallPackagesStep(sis values.System, l logger.KairosLogger) (Plan, error) {
+	data := NewPlan()
+	data.Stages["before-install"] = GetInstallRepositoriesStage(sis, l)
+	installStage, err := GetInstallStage(sis, l)
+	data.Stages["install"] = installStage
+	data.Stages["after-install"] = restoreMirrorsStages()
+	return data, err
+}
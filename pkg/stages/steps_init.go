@@ -28,11 +28,6 @@ import (
 // signed during the build process
 // If we have fips, we need to add the fips support to the initrd as well
 func GetInitrdStage(_ values.System, logger logger.KairosLogger) ([]schema.Stage, error) {
-	if config.ContainsSkipStep(values.InitrdStep) {
-		logger.Logger.Warn().Msg("Skipping initrd generation stage")
-		return []schema.Stage{}, nil
-	}
-
 	stage := []schema.Stage{
 		{
 			Name: "Remove all initrds",
@@ -110,10 +105,6 @@ func getDracutCommand(kernel string, level zerolog.Level) string {
 // For example, for upgrading the version its taken from here
 // During boot, grub checks this file to know things about the system and enable or disable stuff, like console for rpi images
 func GetKairosReleaseStage(sis values.System, log logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.KairosReleaseStep) {
-		log.Logger.Warn().Msg("Skipping /etc/kairos-release generation stage")
-		return []schema.Stage{}
-	}
 	// TODO: Expand tis as this doesn't cover all the current fields
 	// Current missing fields
 	/*
@@ -180,10 +171,13 @@ func GetKairosReleaseStage(sis values.System, log logger.KairosLogger) []schema.
 	}
 
 	// Todo: Change this to allow getting info from several providers? No idea how to store it, the current below is only for k3s/k0s I think
-	versionInfo, err := getProviderInfo(log)
-	if err == nil && versionInfo.Provider != "" && versionInfo.Version != "" {
-		env["KAIROS_SOFTWARE_VERSION"] = versionInfo.Version
-		env["KAIROS_SOFTWARE_VERSION_PREFIX"] = versionInfo.Provider
+	// Providers are not installed on dry runs, so there is nobody to ask
+	if !config.DefaultConfig.DryRun {
+		versionInfo, err := getProviderInfo(log)
+		if err == nil && versionInfo.Provider != "" && versionInfo.Version != "" {
+			env["KAIROS_SOFTWARE_VERSION"] = versionInfo.Version
+			env["KAIROS_SOFTWARE_VERSION_PREFIX"] = versionInfo.Provider
+		}
 	}
 
 	log.Logger.Debug().Interface("env", env).Msg("Kairos release stage")
@@ -245,10 +239,6 @@ func getProviderInfo(logger logger.KairosLogger) (bus.ProviderInstalledVersionPa
 // whole workaround via an apt-cache guard rather than version-gating (the 6.17 noble HWE backport still had
 // modules-extra while 6.17 in questing did not, so a plain version check would misfire).
 func GetWorkaroundsStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.WorkaroundsStep) {
-		l.Logger.Warn().Msg("Skipping workarounds stage")
-		return []schema.Stage{}
-	}
 	stages := []schema.Stage{
 		{
 			Name: "Link grub-editenv to grub2-editenv",
@@ -339,11 +329,6 @@ func GetWorkaroundsStage(_ values.System, l logger.KairosLogger) []schema.Stage
 // we have build the initramfs we dont need them anymore
 // TODO: Remove package cache for all distros
 func GetCleanupStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.CleanupStep) {
-		l.Logger.Warn().Msg("Skipping cleanup stage")
-		return []schema.Stage{}
-	}
-
 	stages := []schema.Stage{
 		{
 			Name: "Remove dbus machine-id",
@@ -412,10 +397,6 @@ func GetCleanupStage(_ values.System, l logger.KairosLogger) []schema.Stage {
 // GetServicesStage Returns the services stage
 // This stage is about configuring the services to be run on the system. Either enabling or disabling them.
 func GetServicesStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.ServicesStep) {
-		l.Logger.Warn().Msg("Skipping services stage")
-		return []schema.Stage{}
-	}
 	return []schema.Stage{
 		{
 			Name:                 "Configure default systemd services",
@@ -643,10 +624,6 @@ func GetServicesStage(_ values.System, l logger.KairosLogger) []schema.Stage {
 // This stage also cleans up the old kernels and initrd files that are no longer needed.
 // This is a bit of a complex one, as every distro has its own way of doing things but we make it work here
 func GetKernelStage(_ values.System, logger logger.KairosLogger) ([]schema.Stage, error) {
-	if config.ContainsSkipStep(values.KernelStep) {
-		logger.Logger.Warn().Msg("Skipping kernel stage")
-		return []schema.Stage{}, nil
-	}
 	kernel, err := getLatestKernel(logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
@@ -776,18 +753,23 @@ func GetKernelStage(_ values.System, logger logger.KairosLogger) ([]schema.Stage
 	}, nil
 }
 
+// KernelPlaceholder is used instead of the kernel version when planning and no kernel is installed yet
+const KernelPlaceholder = "<kernel>"
+
 // getLatestKernel returns the latest kernel version installed on the system.
+// On dry runs the kernel may not be installed yet, so KernelPlaceholder is returned instead of failing
 func getLatestKernel(l logger.KairosLogger) (string, error) {
-	return kernel.GetLatest(config.DefaultConfig.Model, l)
+	k, err := kernel.GetLatest(config.RootPath("/"), config.DefaultConfig.Model, l)
+	if err != nil && config.DefaultConfig.DryRun {
+		l.Logger.Warn().Err(err).Msgf("No kernel found, using %s in the plan", KernelPlaceholder)
+		return KernelPlaceholder, nil
+	}
+	return k, err
 }
 
 // GetKairosInitramfsFilesStage installs the kairos initramfs files
 // This stage is used to install the initramfs files that are needed for the system to boot
 func GetKairosInitramfsFilesStage(sis values.System, l logger.KairosLogger) ([]schema.Stage, error) {
-	if config.ContainsSkipStep(values.InitramfsConfigsStep) {
-		l.Logger.Warn().Msg("Skipping installing initramfs configs stage")
-		return []schema.Stage{}, nil
-	}
 	var data []schema.Stage
 	if config.DefaultConfig.TrustedBoot {
 		l.Logger.Info().Msg("Skipping installing initramfs files stage for trusted boot")
@@ -925,18 +907,18 @@ func GetKairosInitramfsFilesStage(sis values.System, l logger.KairosLogger) ([]s
 			// Start from scratch
 			networkModule = ""
 			// Do we have NetworkManager? Then add it and skip the rest of checks
-			if _, err := os.Stat("/usr/sbin/NetworkManager"); err == nil {
+			if _, err := os.Stat(config.RootPath("/usr/sbin/NetworkManager")); err == nil {
 				networkModule = "network-manager"
 			} else {
 				// Nothing seems to ship networkd modules for dracut in the RHEL+clones so only add them under Fedora
 				if sis.Distro == values.Fedora {
 					// Do we have systemd-networkd?
-					if _, err := os.Stat("/usr/lib/systemd/systemd-networkd"); err == nil {
+					if _, err := os.Stat(config.RootPath("/usr/lib/systemd/systemd-networkd")); err == nil {
 						networkModule = "systemd-networkd"
 						// Systemd resolved modules only make sense if networkd is used alongside
 						// Otherwise other modules provide their own resolvers
 						// Do we have systemd-resolved?
-						if _, err := os.Stat("/usr/lib/systemd/systemd-resolved"); err == nil {
+						if _, err := os.Stat(config.RootPath("/usr/lib/systemd/systemd-resolved")); err == nil {
 							networkModule += " systemd-resolved"
 						}
 					} else {
@@ -1,13 +1,10 @@
 package stages
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -17,6 +14,7 @@ import (
 	semver "github.com/hashicorp/go-version"
 	"github.com/kairos-io/kairos-init/pkg/bundled"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/validation"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/constants"
 	"github.com/kairos-io/kairos-sdk/installer"
@@ -26,12 +24,46 @@ import (
 
 // This file contains the stages for the install process
 
-func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.Stage, error) {
-	if config.ContainsSkipStep(values.InstallPackagesStep) {
-		logger.Logger.Warn().Msg("Skipping install packages stage")
-		return []schema.Stage{}, nil
+// GetInstallRepositoriesStage returns the stages that set up the repositories needed to install the packages
+func GetInstallRepositoriesStage(sis values.System, _ logger.KairosLogger) []schema.Stage {
+	var stage []schema.Stage
+	// On Rpi3 and Rpi4 we need to enable the non-free repository for Debian to get the firmware
+	if config.DefaultConfig.Model == values.Rpi3.String() || config.DefaultConfig.Model == values.Rpi4.String() {
+		stage = append(stage, schema.Stage{
+			Name:     "Enable non-free repository",
+			OnlyIfOs: "Debian.*",
+			Commands: []string{
+				"sed -i 's/^Components: main.*$/& non-free-firmware/' /etc/apt/sources.list.d/debian.sources",
+			},
+		})
+	}
+	return append(withMirrors(stage), mirrorsStages("Use the repository mirrors", sis)...)
+}
+
+// selectPackages removes the excluded packages from the resolved ones and appends the extra ones
+// Excluding a package that provides a binary or file the validator looks for is allowed, but it will fail the validation
+func selectPackages(packages []string, extra []string, logger logger.KairosLogger) []string {
+	var selected []string
+	for _, p := range packages {
+		if !slices.Contains(config.DefaultConfig.ExcludePackages, p) {
+			selected = append(selected, p)
+			continue
+		}
+		logger.Logger.Info().Str("package", p).Msg("Excluding package as per configuration")
+		if required := validation.PackageRequirements(p); len(required) > 0 {
+			logger.Logger.Warn().Str("package", p).Strs("required", required).Msg("Excluded package provides binaries or files required by the validator, provide them in some other way or the validation will fail")
+		}
+	}
+	for _, p := range extra {
+		if !slices.Contains(selected, p) {
+			logger.Logger.Info().Str("package", p).Msg("Adding package as per configuration")
+			selected = append(selected, p)
+		}
 	}
+	return selected
+}
 
+func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.Stage, error) {
 	if sis.Distro == values.Hadron {
 		logger.Logger.Info().Msg("Hadron Linux does not require package installation")
 		return []schema.Stage{}, nil
@@ -53,24 +85,30 @@ func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.St
 		logger.Logger.Error().Msgf("Failed to parse the packages: %s", err)
 		return []schema.Stage{}, err
 	}
+	finalMergedPkgs = selectPackages(finalMergedPkgs, config.DefaultConfig.AddPackages, logger)
+	report.setPackages(values.InstallPackagesStep, finalMergedPkgs)
 
-	// Get the full version from the system info parsed so we can use the major version
-	fullVersion, err := semver.NewSemver(sis.Version)
-	if err != nil {
-		logger.Logger.Error().Msgf("Failed to parse the version %s: %s", sis.Version, err)
-		return []schema.Stage{}, err
+	// Get the major version from the system info parsed for the repositories, rolling releases without one don't use it
+	var majorVersion int
+	if sis.VersionScheme() != values.NoVersionScheme {
+		fullVersion, err := semver.NewSemver(sis.Version)
+		if err != nil {
+			logger.Logger.Error().Msgf("Failed to parse the version %s: %s", sis.Version, err)
+			return []schema.Stage{}, err
+		}
+		majorVersion = fullVersion.Segments()[0]
 	}
 
-	// Read the NVIDIA env variables, use defaults if not set
+	// Read the NVIDIA settings (config file or env variables), use defaults if not set
 	// This was just introduced in PR #211, however if you check the
 	// Dockerfile.nvidia-orin-nx it says 36 :shrug:, do we actually need a
 	// default or should the user always set it? if we have a default, should it
 	// ever change?
-	nvidiaRelease := getEnvOrDefault("NVIDIA_RELEASE", "35")
-	nvidiaVersion := getEnvOrDefault("NVIDIA_VERSION", "3.1")
-	l4tVersion := getEnvOrDefault("L4T_VERSION", "36.4")
+	nvidiaRelease := valueOrDefault(config.DefaultConfig.Nvidia.Release, "35")
+	nvidiaVersion := valueOrDefault(config.DefaultConfig.Nvidia.Version, "3.1")
+	l4tVersion := valueOrDefault(config.DefaultConfig.Nvidia.L4TVersion, "36.4")
 	// Get board model from environment or config
-	boardModel := getEnvOrDefault("BOARD_MODEL", "t234")
+	boardModel := valueOrDefault(config.DefaultConfig.Nvidia.BoardModel, "t234")
 	isNvidiaAgxOrOrinNxBoard := fmt.Sprintf(`[ "%[1]s" = "nvidia-jetson-agx-orin" ] || [ "%[1]s" = "nvidia-jetson-orin-nx" ]`, config.DefaultConfig.Model)
 	isNvidiaThorBoard := fmt.Sprintf(`[ "%s" = "nvidia-jetson-thor" ]`, config.DefaultConfig.Model)
 	// This matches any of the nvidia boards for steps shared between them
@@ -85,7 +123,7 @@ func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.St
 		// board, otherwise it black-screens on boot. See kairos-io/kairos#4228.
 		boardModel = "t264"
 		// renovate: datasource=custom.nvidia-jetson-linux depName=nvidia-jetson-linux
-		l4tVersion = getEnvOrDefault("L4T_VERSION", "39.2.1")
+		l4tVersion = valueOrDefault(config.DefaultConfig.Nvidia.L4TVersion, "39.2.1")
 		logger.Logger.Info().Msgf("NVIDIA Thor detected, using L4T version %s for repository setup", l4tVersion)
 	}
 
@@ -102,7 +140,7 @@ func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.St
 			OnlyIfOs: "Oracle\\sLinux.*",
 			Packages: schema.Packages{
 				Install: []string{
-					fmt.Sprintf("oracle-epel-release-el%d", fullVersion.Segments()[0]),
+					fmt.Sprintf("oracle-epel-release-el%d", majorVersion),
 				},
 			},
 		},
@@ -127,7 +165,7 @@ func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.St
 			Commands: []string{
 				fmt.Sprintf(
 					"dnf install -y epel-release || dnf install -y https://dl.fedoraproject.org/pub/epel/epel-release-latest-%d.noarch.rpm",
-					fullVersion.Segments()[0],
+					majorVersion,
 				),
 			},
 		},
@@ -301,15 +339,16 @@ func GetInstallStage(sis values.System, logger logger.KairosLogger) ([]schema.St
 			},
 		},
 	}
-	return stage, nil
+	// Run the mirrors again to catch the repositories added since the first run, like EPEL
+	stage = withMirrors(stage)
+	if mirrors := mirrorsStages("Use the repository mirrors for the added repositories", sis); len(mirrors) > 0 {
+		i := slices.IndexFunc(stage, func(s schema.Stage) bool { return s.Name == "Install base packages" })
+		stage = slices.Insert(stage, i, mirrors...)
+	}
+	return withPackageCheck(stage, "Install base packages", sis, logger), nil
 }
 
 func GetInstallKernelStage(sis values.System, logger logger.KairosLogger) ([]schema.Stage, error) {
-	if config.ContainsSkipStep(values.InstallKernelStep) {
-		logger.Logger.Warn().Msg("Skipping install kernel stage")
-		return []schema.Stage{}, nil
-	}
-
 	if sis.Distro == values.Hadron {
 		logger.Logger.Info().Msg("Hadron Linux does not require kernel installation")
 		return []schema.Stage{}, nil
@@ -327,6 +366,8 @@ func GetInstallKernelStage(sis values.System, logger logger.KairosLogger) ([]sch
 		logger.Logger.Error().Msgf("Failed to parse the packages: %s", err)
 		return []schema.Stage{}, err
 	}
+	finalMergedPkgs = selectPackages(finalMergedPkgs, nil, logger)
+	report.setPackages(values.InstallKernelStep, finalMergedPkgs)
 
 	stage := []schema.Stage{
 		{
@@ -348,61 +389,73 @@ func GetInstallKernelStage(sis values.System, logger logger.KairosLogger) ([]sch
 		},
 	}
 
-	return stage, nil
+	return withPackageCheck(withMirrors(stage), "Install kernel packages", sis, logger), nil
 }
 
 // GetInstallOemCloudConfigs dumps the OEM files to the system from the embedded oem files
 // TODO: Make them first class yip files in code and just dump them into the system?
 // That way they can be set as a normal yip stage maybe? a yip stage that dumps the yip stage lol
 func GetInstallOemCloudConfigs(l logger.KairosLogger) error {
-	if config.ContainsSkipStep(values.CloudconfigsStep) {
-		l.Logger.Warn().Msg("Skipping installing cloudconfigs stage")
-		return nil
+	actions, err := GetInstallOemCloudConfigsActions(l)
+	if err != nil {
+		return err
 	}
+	return applyActions(actions, l)
+}
+
+// GetInstallOemCloudConfigsActions returns the actions that dump the embedded OEM files into /system/oem
+func GetInstallOemCloudConfigsActions(l logger.KairosLogger) ([]Action, error) {
 	files, err := bundled.EmbeddedConfigs.ReadDir("cloudconfigs")
 	if err != nil {
 		l.Logger.Error().Err(err).Msg("Failed to read embedded files")
-		return err
+		return nil, err
 	}
 
-	// Extract each file
+	var actions []Action
 	for _, file := range files {
-		if !file.IsDir() {
-			data, err := bundled.EmbeddedConfigs.ReadFile(filepath.Join("cloudconfigs", file.Name()))
-			if err != nil {
-				l.Logger.Error().Err(err).Str("file", file.Name()).Msg("Failed to read embedded file")
-				continue
-			}
+		if file.IsDir() {
+			continue
+		}
+		name := filepath.Join("cloudconfigs", file.Name())
+		outputPath := filepath.Join("/system/oem/", file.Name())
+		actions = append(actions, Action{
+			Step:   values.CloudconfigsStep,
+			Kind:   ActionWriteFile,
+			Source: embeddedSource(name),
+			Dest:   outputPath,
+			apply: func(l logger.KairosLogger) error {
+				data, err := bundled.EmbeddedConfigs.ReadFile(name)
+				if err != nil {
+					l.Logger.Error().Err(err).Str("file", file.Name()).Msg("Failed to read embedded file")
+					return nil
+				}
 
-			// check if /system/oem exists and create it if not
-			if _, err = os.Stat("/system/oem"); os.IsNotExist(err) {
-				err = os.MkdirAll("/system/oem", 0755)
+				// check if /system/oem exists and create it if not
+				if _, err = os.Stat(config.RootPath("/system/oem")); os.IsNotExist(err) {
+					err = os.MkdirAll(config.RootPath("/system/oem"), 0755)
+					if err != nil {
+						l.Logger.Error().Err(err).Str("dir", "/system/oem").Msg("Failed to create directory")
+						return nil
+					}
+				}
+				err = os.WriteFile(config.RootPath(outputPath), data, 0644)
 				if err != nil {
-					l.Logger.Error().Err(err).Str("dir", "/system/oem").Msg("Failed to create directory")
-					continue
+					fmt.Printf("Failed to write file %s: %v\n", outputPath, err)
+					return nil
 				}
-			}
-			outputPath := filepath.Join("/system/oem/", file.Name())
-			err = os.WriteFile(outputPath, data, 0644)
-			if err != nil {
-				fmt.Printf("Failed to write file %s: %v\n", outputPath, err)
-				continue
-			}
 
-			l.Logger.Debug().Str("file", outputPath).Msg("Wrote cloud config")
-		}
+				l.Logger.Debug().Str("file", outputPath).Msg("Wrote cloud config")
+				return nil
+			},
+		})
 	}
-	return nil
+	return actions, nil
 }
 
 // GetInstallBrandingStage returns the branding stage
 // This stage takes care of creating the default branding files that are used by the system
 // Thinks like interactive install or recoivery welcome text or grubmenu configs
 func GetInstallBrandingStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.BrandingStep) {
-		l.Logger.Warn().Msg("Skipping installing branding stage")
-		return []schema.Stage{}
-	}
 	var data []schema.Stage
 
 	data = append(data, []schema.Stage{
@@ -453,10 +506,6 @@ func GetInstallBrandingStage(_ values.System, l logger.KairosLogger) []schema.St
 // GetInstallGrubBootArgsStage returns the stage to write the grub configs
 // This stage takes create of creating the /etc/cos/bootargs.cfg and /etc/cos/grub.cfg
 func GetInstallGrubBootArgsStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.GrubStep) {
-		l.Logger.Warn().Msg("Skipping installing grub stage")
-		return []schema.Stage{}
-	}
 	var data []schema.Stage
 	// On trusted boot this is useless
 	if config.DefaultConfig.TrustedBoot {
@@ -498,199 +547,260 @@ func GetInstallGrubBootArgsStage(_ values.System, l logger.KairosLogger) []schem
 // the canonical /system/installer/installer override path), we keep it and skip
 // bundling our embedded copy to keep the image surface small.
 func installKairosInstaller(l logger.KairosLogger) error {
-	if existing, found := installer.Existing("/"); found {
+	if existing, found := installer.Existing(config.RootPath("/")); found {
 		l.Logger.Info().Str("dest", existing).Msg("installer already present, skipping bundling the embedded one")
 		return nil
 	}
-	dest := constants.InstallerDefaultPath
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
-		return err
-	}
-	return os.WriteFile(dest, bundled.EmbeddedKairosInstaller, 0755)
+	return writeBinary(constants.InstallerDefaultPath, bundled.EmbeddedKairosInstaller, l)
 }
 
-// GetInstallKairosBinaries directly installs the kairos binaries from bundled binaries
-func GetInstallKairosBinaries(sis values.System, l logger.KairosLogger) error {
-	if config.ContainsSkipStep(values.KairosBinariesStep) {
-		l.Logger.Warn().Msg("Skipping installing Kairos binaries stage")
-		return nil
+// writeBinary writes the given binary data into dest of the target system, creating the parent dir if needed
+func writeBinary(dest string, data []byte, l logger.KairosLogger) error {
+	dest = config.RootPath(dest)
+	if err := createParentDir(dest, l); err != nil {
+		return err
 	}
-	//  If versions are provided, download and install those instead? i.e. Allow online install versions?
 
-	binaries := map[string]string{
-		constants.AgentDefaultPath:                      config.DefaultConfig.VersionOverrides.Agent,
-		"/usr/bin/immucore":                             config.DefaultConfig.VersionOverrides.Immucore,
-		"/system/discovery/kcrypt-discovery-challenger": config.DefaultConfig.VersionOverrides.KcryptChallenger,
+	err := os.WriteFile(dest, data, 0755)
+	if err != nil {
+		l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to write embedded binary")
+		return err
 	}
+	return nil
+}
 
-	for dest, version := range binaries {
-		if version != "" {
-			// Create the directory if it doesn't exist
-			if _, err := os.Stat(filepath.Dir(dest)); os.IsNotExist(err) {
-				err := os.MkdirAll(filepath.Dir(dest), 0755)
-				if err != nil {
-					l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
-				}
-			}
-
-			reponame := filepath.Base(dest)
-			url := fmt.Sprintf("https://github.com/kairos-io/%[1]s/releases/download/%[2]s/%[1]s-%[2]s-Linux-%[3]s", reponame, version, sis.Arch)
-			// Append -fips to the url if fips is enabled
-			if config.DefaultConfig.Fips {
-				url = fmt.Sprintf("%s-fips", url)
+// downloadBinaryAction returns the action that downloads the given version from url and extracts the binary into dest
+// The download is verified with the given sha256, or the checksums file of the release if empty
+func downloadBinaryAction(step, version, url, checksum, dest string, binaryName ...string) Action {
+	return Action{
+		Step:     step,
+		Kind:     ActionDownload,
+		Source:   url,
+		Dest:     dest,
+		Version:  version,
+		Checksum: checksum,
+		apply: func(l logger.KairosLogger) error {
+			dest := config.RootPath(dest)
+			if err := createParentDir(dest, l); err != nil {
+				return err
 			}
-			// Add the .tar.gz to the url
-			url = fmt.Sprintf("%s.tar.gz", url)
 			l.Logger.Info().Str("url", url).Msg("Downloading binary")
-			err := DownloadAndExtract(url, dest)
+			err := DownloadAndExtract(url, dest, checksum, l, binaryName...)
 			if err != nil {
 				l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to download and extract binary")
 				return err
 			}
-		} else {
-			// Use embedded binaries
-			var data []byte
-			switch dest {
-			case constants.AgentDefaultPath:
-				data = bundled.EmbeddedAgent
-			case "/usr/bin/immucore":
-				data = bundled.EmbeddedImmucore
-			case "/system/discovery/kcrypt-discovery-challenger":
-				data = bundled.EmbeddedKcryptChallenger
-			}
+			return nil
+		},
+	}
+}
 
-			// Create the directory if it doesn't exist
-			if _, err := os.Stat(filepath.Dir(dest)); os.IsNotExist(err) {
-				err := os.MkdirAll(filepath.Dir(dest), 0755)
-				if err != nil {
-					l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
-				}
+// localBinaryAction returns the action that copies the local binary, archive or directory with it at src into dest
+func localBinaryAction(step, src, checksum, dest string, binaryName ...string) Action {
+	return Action{
+		Step:     step,
+		Kind:     ActionCopy,
+		Source:   src,
+		Dest:     dest,
+		Checksum: checksum,
+		apply: func(l logger.KairosLogger) error {
+			dest := config.RootPath(dest)
+			if err := createParentDir(dest, l); err != nil {
+				return err
 			}
-
-			err := os.WriteFile(dest, data, 0755)
+			l.Logger.Info().Str("path", src).Msg("Copying local binary")
+			err := CopyLocalBinary(src, dest, checksum, binaryName...)
 			if err != nil {
-				l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to write embedded binary")
+				l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to copy local binary")
 				return err
 			}
-		}
-	}
-
-	if err := installKairosInstaller(l); err != nil {
-		l.Logger.Error().Err(err).Msg("Failed to install kairos-installer")
-		return err
+			return nil
+		},
 	}
-
-	return nil
 }
 
-// GetInstallProviderBinaries installs the provider and edgevpn binaries
-func GetInstallProviderBinaries(sis values.System, l logger.KairosLogger) error {
-	if config.ContainsSkipStep(values.ProviderBinariesStep) {
-		l.Logger.Warn().Msg("Skipping installing Kairos k8s provider binaries stage")
-		return nil
+// overrideBinaryAction returns the action that installs the binary of a version override into dest
+// The override is either a release version, downloaded from releaseURL, any url or a local path.
+func overrideBinaryAction(step, override, releaseURL, checksum, dest string, binaryName ...string) Action {
+	if url, ok := overrideURL(override); ok {
+		return downloadBinaryAction(step, "", url, checksum, dest, binaryName...)
 	}
-	// If its core we dont do anything here
-	if config.DefaultConfig.Variant.String() == "core" {
-		return nil
+	if src, ok := overridePath(override); ok {
+		return localBinaryAction(step, src, checksum, dest, binaryName...)
 	}
+	return downloadBinaryAction(step, override, releaseURL, checksum, dest, binaryName...)
+}
 
-	err := os.MkdirAll("/system/providers", os.ModeDir|os.ModePerm)
-	if err != nil {
-		l.Logger.Error().Err(err).Msg("Failed to create directory")
-		return err
+// archiveNames returns what the binary installed into dest is looked up by in its archive, the configured path or
+// the name it's installed with and the alternative ones
+func archiveNames(binary, dest string, alternatives ...string) []string {
+	if p := config.DefaultConfig.VersionOverrides.ArchivePaths[binary]; p != "" {
+		return []string{p}
 	}
+	return slices.Compact(append([]string{filepath.Base(dest)}, alternatives...))
+}
 
-	binaries := map[string]string{
-		"/system/providers/agent-provider-kairos": config.DefaultConfig.VersionOverrides.Provider,
-		"/usr/bin/edgevpn":                        config.DefaultConfig.VersionOverrides.EdgeVpn,
+// createParentDir creates the directory of dest if it doesn't exist
+func createParentDir(dest string, l logger.KairosLogger) error {
+	if _, err := os.Stat(filepath.Dir(dest)); os.IsNotExist(err) {
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
+			return err
+		}
 	}
+	return nil
+}
 
-	for dest, version := range binaries {
-		if version != "" {
-			// Create the directory if it doesn't exist
-			if _, err := os.Stat(filepath.Dir(dest)); os.IsNotExist(err) {
-				err := os.MkdirAll(filepath.Dir(dest), 0755)
-				if err != nil {
-					l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
-					return err
-				}
-			}
+// embeddedBinaryAction returns the action that writes the embedded binary data into dest
+func embeddedBinaryAction(step, name, dest string, data []byte) Action {
+	return Action{
+		Step:    step,
+		Kind:    ActionWriteFile,
+		Source:  embeddedSource(name),
+		Dest:    dest,
+		Version: embeddedVersions()[name],
+		apply: func(l logger.KairosLogger) error {
+			return writeBinary(dest, data, l)
+		},
+	}
+}
 
-			org := "kairos-io"
-			arch := sis.Arch
-			// Check if the destination is edgevpn, if so we need to use mudler as the org
-			// And change the arch to x86_64 if its amd64
-			if dest == "/usr/bin/edgevpn" {
-				org = "mudler"
-				if arch == "amd64" {
-					arch = "x86_64"
-				}
-			}
-			// Binary destination has the prefix agent- so we need to remove it as the repo does not have it, nor the file
-			binaryName := strings.Replace(filepath.Base(dest), "agent-", "", 1)
-			url := fmt.Sprintf("https://github.com/%[4]s/%[1]s/releases/download/%[2]s/%[1]s-%[2]s-Linux-%[3]s", binaryName, version, arch, org)
+// GetInstallKairosBinaries directly installs the kairos binaries from bundled binaries
+func GetInstallKairosBinaries(sis values.System, l logger.KairosLogger) error {
+	return applyActions(GetInstallKairosBinariesActions(sis, l), l)
+}
 
-			// Append -fips to the url if fips is enabled for provider only
-			if config.DefaultConfig.Fips && dest != "/usr/bin/edgevpn" {
-				url = fmt.Sprintf("%s-fips", url)
-			}
-			// Add the .tar.gz to the url
-			url = fmt.Sprintf("%s.tar.gz", url)
-			l.Logger.Info().Str("url", url).Msg("Downloading binary")
-			err := DownloadAndExtract(url, dest, binaryName)
-			if err != nil {
-				l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to download and extract binary")
-				return err
+// GetInstallKairosBinariesActions returns the actions that install the kairos binaries, either from the bundled
+// binaries, their FIPS builds for FIPS images, or from the overrides: a version to download, a url or a local path
+func GetInstallKairosBinariesActions(sis values.System, l logger.KairosLogger) []Action {
+	agentEmbedded, immucoreEmbedded, kcryptChallengerEmbedded := bundled.EmbeddedAgent, bundled.EmbeddedImmucore, bundled.EmbeddedKcryptChallenger
+	if config.DefaultConfig.Fips {
+		agentEmbedded, immucoreEmbedded, kcryptChallengerEmbedded = bundled.EmbeddedAgentFips, bundled.EmbeddedImmucoreFips, bundled.EmbeddedKcryptChallengerFips
+	}
+
+	overrides := config.DefaultConfig.VersionOverrides
+	binaries := []struct {
+		key      string
+		dest     string
+		version  string
+		embedded []byte
+	}{
+		{config.AgentBinary, constants.AgentDefaultPath, overrides.Agent, agentEmbedded},
+		{config.ImmucoreBinary, "/usr/bin/immucore", overrides.Immucore, immucoreEmbedded},
+		{config.KcryptChallengerBinary, "/system/discovery/kcrypt-discovery-challenger", overrides.KcryptChallenger, kcryptChallengerEmbedded},
+	}
+
+	var actions []Action
+	for _, b := range binaries {
+		reponame := filepath.Base(b.dest)
+		if b.version != "" {
+			vars := config.ReleaseURLVars{Repo: reponame, Org: "kairos-io", Version: b.version, Arch: sis.Arch.String(), ArchAlias: archAlias(sis.Arch)}
+			// Append -fips to the url if fips is enabled
+			if config.DefaultConfig.Fips {
+				vars.Fips = "-fips"
 			}
+			url := releaseURL(b.key, vars, l)
+			actions = append(actions, overrideBinaryAction(values.KairosBinariesStep, b.version, url, overrides.Checksums[b.key], b.dest, archiveNames(b.key, b.dest)...))
 		} else {
 			// Use embedded binaries
-			var data []byte
-			switch dest {
-			case "/system/providers/agent-provider-kairos":
-				if config.DefaultConfig.Fips {
-					data = bundled.EmbeddedKairosProviderFips
-				} else {
-					data = bundled.EmbeddedKairosProvider
-				}
-			case "/usr/bin/edgevpn":
-				data = bundled.EmbeddedEdgeVPN
-			}
+			actions = append(actions, embeddedBinaryAction(values.KairosBinariesStep, reponame, b.dest, b.embedded))
+		}
+	}
 
-			// Create the directory if it doesn't exist
-			if _, err := os.Stat(filepath.Dir(dest)); os.IsNotExist(err) {
-				err := os.MkdirAll(filepath.Dir(dest), 0755)
-				if err != nil {
-					l.Logger.Error().Err(err).Str("dir", filepath.Dir(dest)).Msg("Failed to create directory")
+	if existing, found := installer.Existing(config.RootPath("/")); found {
+		l.Logger.Debug().Str("dest", existing).Msg("installer already present, not planning the embedded one")
+	} else {
+		actions = append(actions, Action{
+			Step:   values.KairosBinariesStep,
+			Kind:   ActionWriteFile,
+			Source: embeddedSource("kairos-installer"),
+			Dest:   constants.InstallerDefaultPath,
+			apply: func(l logger.KairosLogger) error {
+				if err := installKairosInstaller(l); err != nil {
+					l.Logger.Error().Err(err).Msg("Failed to install kairos-installer")
+					return err
 				}
-			}
+				return nil
+			},
+		})
+	}
 
-			err := os.WriteFile(dest, data, 0755)
-			if err != nil {
-				l.Logger.Error().Err(err).Str("binary", dest).Msg("Failed to write embedded binary")
-				return err
+	return actions
+}
+
+// GetInstallProviderBinaries installs the provider and edgevpn binaries
+func GetInstallProviderBinaries(sis values.System, l logger.KairosLogger) error {
+	return applyActions(GetInstallProviderBinariesActions(sis, l), l)
+}
+
+// GetInstallProviderBinariesActions returns the actions that install the provider and edgevpn binaries
+func GetInstallProviderBinariesActions(sis values.System, l logger.KairosLogger) []Action {
+	// If its core we dont do anything here
+	if config.DefaultConfig.Variant.String() == "core" {
+		return nil
+	}
+
+	providerEmbedded := bundled.EmbeddedKairosProvider
+	if config.DefaultConfig.Fips {
+		providerEmbedded = bundled.EmbeddedKairosProviderFips
+	}
+
+	overrides := config.DefaultConfig.VersionOverrides
+	binaries := []struct {
+		key      string
+		dest     string
+		version  string
+		embedded []byte
+	}{
+		{config.ProviderBinary, "/system/providers/agent-provider-kairos", overrides.Provider, providerEmbedded},
+		{config.EdgeVpnBinary, "/usr/bin/edgevpn", overrides.EdgeVpn, bundled.EmbeddedEdgeVPN},
+	}
+
+	var actions []Action
+	for _, b := range binaries {
+		// Binary destination has the prefix agent- so we need to remove it as the repo does not have it, nor the file
+		binaryName := strings.Replace(filepath.Base(b.dest), "agent-", "", 1)
+		if b.version != "" {
+			vars := config.ReleaseURLVars{Repo: binaryName, Org: "kairos-io", Version: b.version, Arch: sis.Arch.String(), ArchAlias: archAlias(sis.Arch)}
+			// edgevpn is released under the mudler org and has no fips builds
+			if b.key == config.EdgeVpnBinary {
+				vars.Org = "mudler"
+			} else if config.DefaultConfig.Fips {
+				vars.Fips = "-fips"
 			}
+			url := releaseURL(b.key, vars, l)
+			// The binary is matched with and without the agent- prefix, as the release archives have had both
+			names := archiveNames(b.key, b.dest, binaryName)
+			actions = append(actions, overrideBinaryAction(values.ProviderBinariesStep, b.version, url, overrides.Checksums[b.key], b.dest, names...))
+		} else {
+			// Use embedded binaries
+			actions = append(actions, embeddedBinaryAction(values.ProviderBinariesStep, binaryName, b.dest, b.embedded))
 		}
 	}
 
 	// Link /system/providers/agent-provider-kairos to /usr/bin/kairos, not sure what uses it?
 	// TODO: Check if this is needed, maybe we can remove it?
-	err = os.Symlink("/system/providers/agent-provider-kairos", "/usr/bin/kairos")
-	if err != nil {
-		l.Logger.Error().Err(err).Msg("Failed to create symlink")
-		return err
-	}
-	return nil
+	actions = append(actions, Action{
+		Step:   values.ProviderBinariesStep,
+		Kind:   ActionSymlink,
+		Source: "/system/providers/agent-provider-kairos",
+		Dest:   "/usr/bin/kairos",
+		apply: func(l logger.KairosLogger) error {
+			err := os.Symlink("/system/providers/agent-provider-kairos", config.RootPath("/usr/bin/kairos"))
+			if err != nil {
+				l.Logger.Error().Err(err).Msg("Failed to create symlink")
+				return err
+			}
+			return nil
+		},
+	})
+	return actions
 }
 
 // GetKairosMiscellaneousFilesStage installs the kairos miscellaneous files
 // Like small scripts or other files that are not part of the main install process
 func GetKairosMiscellaneousFilesStage(sis values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.MiscellaneousStep) {
-		l.Logger.Warn().Msg("Skipping installing miscellaneous configs stage")
-		return []schema.Stage{}
-	}
-
 	var data []schema.Stage
 
 	data = append(data, []schema.Stage{
@@ -742,69 +852,29 @@ func GetKairosMiscellaneousFilesStage(sis values.System, l logger.KairosLogger)
 	return data
 }
 
-// DownloadAndExtract downloads a tar.gz file from the specified URL, extracts its contents,
-// and searches for a binary file to move to the destination path. If a binary name is provided
-// as an optional parameter, it uses that name to locate the binary in the archive; otherwise,
-// it defaults to using the base name of the destination path. The function returns an error
-// if the download, extraction, or file operations fail, or if the binary is not found in the archive.
-func DownloadAndExtract(url, dest string, binaryName ...string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
-	}
-	defer resp.Body.Close()
-
-	gzr, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+// ProviderBuildInstallEventActions returns the action that triggers the build-install event for the configured providers
+func ProviderBuildInstallEventActions(sis values.System, _ logger.KairosLogger) []Action {
+	if len(config.DefaultConfig.Providers) == 0 {
+		return nil
 	}
-	defer gzr.Close()
-
-	tarReader := tar.NewReader(gzr)
-	targetBinary := filepath.Base(dest)
-	if len(binaryName) > 0 {
-		targetBinary = binaryName[0]
+	names := make([]string, 0, len(config.DefaultConfig.Providers))
+	for _, provider := range config.DefaultConfig.Providers {
+		names = append(names, provider.Name)
 	}
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to read tar file: %w", err)
-		}
-
-		if header.Typeflag == tar.TypeReg && strings.HasSuffix(header.Name, targetBinary) {
-			outFile, err := os.Create(dest)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
-			}
-			defer outFile.Close()
-
-			_, err = io.Copy(outFile, tarReader)
-			if err != nil {
-				return fmt.Errorf("failed to copy file content: %w", err)
-			}
-			// Set the file permissions
-
-			err = outFile.Chmod(0755)
-			if err != nil {
-				return fmt.Errorf("failed to set file permissions: %w", err)
-			}
-
-			return nil
-		}
+	return []Action{
+		{
+			Step:   values.BuildProviderStep,
+			Kind:   ActionProviderEvent,
+			Source: strings.Join(names, ","),
+			apply: func(l logger.KairosLogger) error {
+				return ProviderBuildInstallEvent(sis, l)
+			},
+		},
 	}
-	return fmt.Errorf("binary not found in archive")
 }
 
+// ProviderBuildInstallEvent triggers the build-install event for the configured providers and waits for their responses
 func ProviderBuildInstallEvent(sis values.System, logger logger.KairosLogger) error {
-	if config.ContainsSkipStep(values.BuildProviderStep) {
-		logger.Logger.Warn().Msg("Skipping calling build for providers stage")
-		return nil
-	}
-
 	providerCount := len(config.DefaultConfig.Providers)
 	if providerCount == 0 {
 		logger.Logger.Info().Msg("No providers configured, skipping provider install event")
@@ -826,6 +896,7 @@ func ProviderBuildInstallEvent(sis values.System, logger logger.KairosLogger) er
 
 	manager.Response(bus.InitProviderInstall, func(p *pluggable.Plugin, resp *pluggable.EventResponse) {
 		logger.Logger.Debug().Str("at", p.Executable).Interface("resp", resp).Msg("Received build-install event from provider")
+		report.addProviderEvent(ProviderEventReport{Plugin: p.Name, State: resp.State, Error: resp.Error})
 		if resp.Errored() {
 			errChan <- fmt.Errorf("provider build-install event failed: %s", resp.Error)
 			wg.Done()
@@ -881,9 +952,9 @@ func ProviderBuildInstallEvent(sis values.System, logger logger.KairosLogger) er
 	return nil
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
-	value, exists := os.LookupEnv(key)
-	if !exists {
+// valueOrDefault returns the value if set, otherwise the default value
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
 		return defaultValue
 	}
 	return value
@@ -0,0 +1,120 @@
+package stages_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+var _ = Describe("Package selection", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+	sis := values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}
+
+	installed := func(st []schema.Stage) []string {
+		var pkgs []string
+		for _, s := range st {
+			pkgs = append(pkgs, s.Packages.Install...)
+		}
+		return pkgs
+	}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+		config.DefaultConfig.Model = values.Generic.String()
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	It("excludes and adds packages after resolving them", func() {
+		config.DefaultConfig.ExcludePackages = []string{"nano", "fail2ban", "linux-image-generic-hwe-24.04"}
+		config.DefaultConfig.AddPackages = []string{"htop", "jq"}
+
+		st, err := stages.GetInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		pkgs := installed(st)
+		Expect(pkgs).ToNot(ContainElement("nano"))
+		Expect(pkgs).ToNot(ContainElement("fail2ban"))
+		Expect(pkgs).To(ContainElement("htop"))
+		// Already there, not added twice
+		count := 0
+		for _, p := range pkgs {
+			if p == "jq" {
+				count++
+			}
+		}
+		Expect(count).To(Equal(1))
+
+		// Exclusions apply to the rendered names of the kernel packages too, extra packages are only base packages
+		st, err = stages.GetInstallKernelStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(installed(st)).ToNot(ContainElement("linux-image-generic-hwe-24.04"))
+		Expect(installed(st)).ToNot(ContainElement("htop"))
+	})
+})
+
+var _ = Describe("Package availability check", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+	sis := values.System{Distro: values.RockyLinux, Family: values.RedHatFamily, Version: "9.4", Arch: values.ArchAMD64}
+
+	indexOf := func(st []schema.Stage, name string) int {
+		for i, s := range st {
+			if s.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+		config.DefaultConfig.Model = values.Generic.String()
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	It("checks the packages right before installing them", func() {
+		st, err := stages.GetInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		install := indexOf(st, "Install base packages")
+		Expect(install).To(BeNumerically(">", 0))
+		Expect(st[install-1].Name).To(Equal("Install base packages: check they are available"))
+		Expect(st[install-1].Commands[0]).To(ContainSubstring("dnf info"))
+		Expect(st[install-1].Commands[0]).To(ContainSubstring(strings.Join(st[install].Packages.Install, " ")))
+
+		st, err = stages.GetInstallKernelStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(indexOf(st, "Install kernel packages: check they are available")).To(Equal(indexOf(st, "Install kernel packages") - 1))
+	})
+
+	It("installs the optional packages apart, only if they are available", func() {
+		config.DefaultConfig.OptionalPackages = []string{"qemu-guest-agent"}
+		st, err := stages.GetInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		install := indexOf(st, "Install base packages")
+		Expect(st[install].Packages.Install).ToNot(ContainElement("qemu-guest-agent"))
+		Expect(st[install+1].Name).To(Equal("Install base packages: optional ones that are available"))
+		Expect(st[install+1].Commands[0]).To(ContainSubstring("for p in qemu-guest-agent;"))
+	})
+
+	It("can be skipped", func() {
+		config.DefaultConfig.SkipPackageCheck = true
+		st, err := stages.GetInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(indexOf(st, "Install base packages: check they are available")).To(Equal(-1))
+	})
+})
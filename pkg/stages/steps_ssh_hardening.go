@@ -2,7 +2,6 @@ package stages
 
 import (
 	"github.com/kairos-io/kairos-init/pkg/bundled"
-	"github.com/kairos-io/kairos-init/pkg/config"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types/logger"
 	"github.com/mudler/yip/pkg/schema"
@@ -26,11 +25,6 @@ const hasSntrup761Kex = `[ "$(printf '8.5\n%s\n' "$(sshd -h 2>&1 | grep -oE 'Ope
 // bundled.SshdHardeningConfig for the ruleset; the spec we track is the
 // DevSec ssh-baseline.
 func GetSshHardeningStage(_ values.System, l logger.KairosLogger) []schema.Stage {
-	if config.ContainsSkipStep(values.SshHardeningStep) {
-		l.Logger.Warn().Msg("Skipping ssh hardening stage")
-		return []schema.Stage{}
-	}
-
 	return []schema.Stage{
 		{
 			Name: "Install sshd hardening drop-in",
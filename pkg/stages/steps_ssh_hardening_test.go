@@ -6,6 +6,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	semver "github.com/hashicorp/go-version"
 	"github.com/kairos-io/kairos-init/pkg/bundled"
 	"github.com/kairos-io/kairos-init/pkg/config"
 	"github.com/kairos-io/kairos-init/pkg/stages"
@@ -76,19 +77,27 @@ var _ = Describe("GetSshHardeningStage", func() {
 	})
 
 	Context("when the skip step is configured", func() {
-		var previous []string
+		var previous config.Config
 
 		BeforeEach(func() {
-			previous = config.DefaultConfig.SkipSteps
+			previous = config.DefaultConfig
 			config.DefaultConfig.SkipSteps = []string{values.SshHardeningStep}
+			config.DefaultConfig.KairosVersion = *semver.Must(semver.NewVersion("1.0.0"))
+			// Don't look for a kernel in the running system
+			config.DefaultConfig.DryRun = true
 		})
 
 		AfterEach(func() {
-			config.DefaultConfig.SkipSteps = previous
+			config.DefaultConfig = previous
 		})
 
-		It("returns no stages", func() {
-			Expect(stages.GetSshHardeningStage(values.System{}, log)).To(BeEmpty())
+		It("is not part of the init stage", func() {
+			plan, err := stages.BuildInitStage(values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}, log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Stages["init"]).ToNot(BeEmpty())
+			for _, st := range plan.Stages["init"] {
+				Expect(st.Name).ToNot(ContainSubstring("sshd hardening"))
+			}
 		})
 	})
 })
@@ -0,0 +1,161 @@
+package stages_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/kairos-io/kairos-init/pkg/bundled"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/constants"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+	"github.com/rs/zerolog"
+)
+
+var _ = Describe("Steps registry", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+	sis := values.System{Distro: values.Ubuntu, Family: values.DebianFamily, Version: "24.04", Arch: values.ArchAMD64}
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	It("returns the steps of a stage in order", func() {
+		steps := stages.Steps(values.InitStage)
+		Expect(steps).ToNot(BeEmpty())
+		Expect(steps[0].Name()).To(Equal(values.KairosReleaseStep))
+		for i := 1; i < len(steps); i++ {
+			Expect(steps[i].Order()).To(BeNumerically(">", steps[i-1].Order()))
+			Expect(steps[i].Stage()).To(Equal(values.InitStage))
+		}
+	})
+
+	It("lists the stages followed by their steps", func() {
+		info := stages.StepsInfo()
+		Expect(info[0].Key).To(Equal(values.InstallStage))
+		Expect(info[0].Value).To(ContainSubstring(values.InstallPackagesStep))
+		names := stages.GetStepNames()
+		Expect(names).To(ContainElements(values.InstallStage, values.InitStage, values.InitrdStep, values.KairosBinariesStep))
+		Expect(names).To(HaveLen(len(stages.Steps(values.InstallStage)) + len(stages.Steps(values.InitStage)) + 2))
+	})
+
+	It("keeps the removed steps as deprecated names", func() {
+		reason, ok := stages.DeprecatedStep(values.KubernetesStep)
+		Expect(ok).To(BeTrue())
+		Expect(reason).To(ContainSubstring(values.ProviderBinariesStep))
+		Expect(stages.DeprecatedStepNames()).To(Equal([]string{values.KubernetesStep}))
+		Expect(stages.GetStepNames()).ToNot(ContainElement(values.KubernetesStep))
+		_, ok = stages.DeprecatedStep(values.InitrdStep)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("refuses to register a step twice", func() {
+		step, found := stages.GetStep(values.InitrdStep)
+		Expect(found).To(BeTrue())
+		Expect(func() { stages.RegisterStep(step) }).To(Panic())
+	})
+
+	It("does not build skipped steps", func() {
+		config.DefaultConfig.SkipSteps = []string{values.KairosBinariesStep, values.CloudconfigsStep}
+		plan, err := stages.BuildInstallStage(sis, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Stages["install"]).ToNot(BeEmpty())
+		for _, a := range plan.Actions {
+			Expect(a.Step).ToNot(BeElementOf(values.KairosBinariesStep, values.CloudconfigsStep))
+		}
+	})
+})
+
+var _ = Describe("ValidateSkipSteps", func() {
+	var log logger.KairosLogger
+	var previous config.Config
+
+	BeforeEach(func() {
+		log = logger.NewKairosLogger("test", "error", true)
+		previous = config.DefaultConfig
+		// Use an empty root so nothing is provided by the system running the tests
+		config.DefaultConfig.Root = GinkgoT().TempDir()
+	})
+
+	AfterEach(func() {
+		config.DefaultConfig = previous
+	})
+
+	It("accepts skipping nothing", func() {
+		Expect(stages.ValidateSkipSteps("all", log)).To(Succeed())
+	})
+
+	It("rejects skipping a step that others require", func() {
+		config.DefaultConfig.SkipSteps = []string{values.KernelStep}
+		err := stages.ValidateSkipSteps("all", log)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("step initrd requires"))
+		Expect(err.Error()).To(ContainSubstring("skipped kernel step"))
+	})
+
+	It("rejects skipping the whole stage that provides a requirement", func() {
+		config.DefaultConfig.SkipSteps = []string{values.InstallStage}
+		err := stages.ValidateSkipSteps("all", log)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("step kernel requires"))
+		Expect(err.Error()).To(ContainSubstring("step initramfsConfigs requires"))
+	})
+
+	It("accepts skipping the steps that depend on the skipped one too", func() {
+		config.DefaultConfig.SkipSteps = []string{values.KernelStep, values.InitrdStep}
+		Expect(stages.ValidateSkipSteps("all", log)).To(Succeed())
+	})
+
+	It("accepts skipping a step when the system already has what it provides", func() {
+		Expect(os.MkdirAll(filepath.Join(config.DefaultConfig.Root, "usr", "bin"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(config.DefaultConfig.Root, filepath.Dir(constants.AgentDefaultPath)), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(config.DefaultConfig.Root, "usr", "bin", "immucore"), []byte{}, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(config.DefaultConfig.Root, constants.AgentDefaultPath), []byte{}, 0755)).To(Succeed())
+		config.DefaultConfig.SkipSteps = []string{values.KairosBinariesStep}
+		Expect(stages.ValidateSkipSteps("all", log)).To(Succeed())
+	})
+
+	It("only checks the steps of the stage being run", func() {
+		config.DefaultConfig.SkipSteps = []string{values.KernelStep}
+		Expect(stages.ValidateSkipSteps(values.InstallStage, log)).To(Succeed())
+		Expect(stages.ValidateSkipSteps(values.InitStage, log)).ToNot(Succeed())
+	})
+
+	It("requires what the stages that aren't run provide to be in the system", func() {
+		err := stages.ValidateSkipSteps(values.InitStage, log)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("step kernel requires"))
+		Expect(err.Error()).To(ContainSubstring("of a stage that isn't run"))
+	})
+
+	It("only warns when a wanted step is skipped", func() {
+		var out bytes.Buffer
+		log.Logger = zerolog.New(&out)
+		config.DefaultConfig.SkipSteps = []string{values.InitramfsConfigsStep}
+		Expect(stages.ValidateSkipSteps("all", log)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("initramfs configs and modules, not found in the system"))
+	})
+
+	It("doesn't warn when the system already has the initramfs configs", func() {
+		var out bytes.Buffer
+		log.Logger = zerolog.New(&out)
+		for _, f := range []string{bundled.DracutConfigPath, bundled.DracutImmucoreModuleSetupPath} {
+			Expect(os.MkdirAll(filepath.Join(config.DefaultConfig.Root, filepath.Dir(f)), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(config.DefaultConfig.Root, f), []byte{}, 0644)).To(Succeed())
+		}
+		config.DefaultConfig.SkipSteps = []string{values.InitramfsConfigsStep}
+		Expect(stages.ValidateSkipSteps("all", log)).To(Succeed())
+		Expect(out.String()).ToNot(ContainSubstring("initramfs configs"))
+	})
+})
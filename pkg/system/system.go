@@ -1,8 +1,11 @@
 package system
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
 	"github.com/joho/godotenv"
@@ -11,18 +14,18 @@ import (
 	"github.com/sanity-io/litter"
 )
 
-// DetectSystem detects the system based on the os-release file
-// and returns a values.System struct
+// DetectSystem detects the system based on the os-release file under root
+// and returns a values.System struct. Pass "/" to detect the running system
 // This could probably be implemented in a different way, or use a lib but its helpful
 // in conjunction with the values packagemaps to determine the packages to install
-func DetectSystem(l logger.KairosLogger) values.System {
+func DetectSystem(root string, l logger.KairosLogger) values.System {
 	// Detects the system
 	s := values.System{
 		Distro: values.Unknown,
 		Family: values.UnknownFamily,
 	}
 
-	file, err := os.Open("/etc/os-release")
+	file, err := os.Open(filepath.Join(root, "/etc/os-release"))
 	if err != nil {
 		return s
 	}
@@ -74,6 +77,21 @@ func DetectSystem(l logger.KairosLogger) values.System {
 	return s
 }
 
+// NewSystem returns the system for the given os-release ID, version and arch, to work out what kairos-init would do
+// on a system without having it
+func NewSystem(id, version string, arch values.Architecture) (values.System, error) {
+	s := values.System{Version: version, Arch: arch}
+	s.Distro, s.Family = detectFromID(id)
+	if s.Distro == values.Unknown {
+		return s, fmt.Errorf("unknown distro %s", id)
+	}
+	if !slices.Contains([]values.Architecture{values.ArchAMD64, values.ArchARM64, values.ArchRiscV64}, arch) {
+		return s, fmt.Errorf("unknown arch %s", arch)
+	}
+	s.Name = strings.TrimSpace(fmt.Sprintf("%s %s", id, version))
+	return s, nil
+}
+
 // detectFromReleaseIDs resolves distro/family using ID first and ID_LIKE as fallback.
 // ID is authoritative; ID_LIKE is only consulted when ID is not recognized.
 func detectFromReleaseIDs(id, idLike string) (values.Distro, values.Family) {
@@ -144,3 +162,76 @@ func detectFromIDLike(idLike string) (values.Distro, values.Family) {
 
 	return values.Unknown, values.UnknownFamily
 }
+
+// DefaultPath is the PATH used to look for binaries inside a root
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// LookPath searches for an executable named file in the given dirs under root, like exec.LookPath does for the
+// running system. The returned path is relative to root.
+func LookPath(root, file string, dirs []string) (string, error) {
+	if strings.Contains(file, "/") {
+		if isExecutable(root, file) {
+			return file, nil
+		}
+		return "", fmt.Errorf("executable file %s not found in %s", file, root)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, file)
+		if isExecutable(root, path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("executable file %s not found in %s", file, root)
+}
+
+func isExecutable(root, path string) bool {
+	resolved, err := ResolvePath(root, path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(root, resolved))
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// ResolvePath follows the symlinks in path as if root was /, so absolute links are not resolved
+// against the running system. The returned path is relative to root.
+func ResolvePath(root, path string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(path, "/")
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("too many links resolving %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return resolved, nil
+}
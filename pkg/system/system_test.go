@@ -1,9 +1,12 @@
 package system
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types/logger"
 )
 
 func TestDetectFromReleaseIDs(t *testing.T) {
@@ -69,3 +72,100 @@ func TestDetectFromReleaseIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectSystemFromRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	osRelease := "ID=alpine\nVERSION_ID=3.21.2\nPRETTY_NAME=\"Alpine Linux v3.21\"\n"
+	if err := os.WriteFile(filepath.Join(root, "etc", "os-release"), []byte(osRelease), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := DetectSystem(root, logger.NewKairosLogger("test", "error", true))
+	if s.Distro != values.Alpine || s.Family != values.AlpineFamily {
+		t.Errorf("expected alpine, got %q/%q", s.Distro, s.Family)
+	}
+	if s.Version != "3.21" {
+		t.Errorf("expected version 3.21, got %q", s.Version)
+	}
+	if s.Name != "Alpine Linux v3.21" {
+		t.Errorf("expected name from PRETTY_NAME, got %q", s.Name)
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"bin", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "bin", "busybox"), []byte("#!/bin/true"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr", "bin", "notexec"), []byte(""), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Absolute link, only valid inside the root
+	if err := os.Symlink("/bin/busybox", filepath.Join(root, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+	// Relative link going up
+	if err := os.Symlink("../../bin/busybox", filepath.Join(root, "usr", "bin", "less")); err != nil {
+		t.Fatal(err)
+	}
+	dirs := filepath.SplitList(DefaultPath)
+
+	tests := []struct {
+		file     string
+		expected string
+		fails    bool
+	}{
+		{file: "sh", expected: "/bin/sh"},
+		{file: "less", expected: "/usr/bin/less"},
+		{file: "/bin/sh", expected: "/bin/sh"},
+		{file: "notexec", fails: true},
+		{file: "missing", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path, err := LookPath(root, tt.file, dirs)
+			if tt.fails {
+				if err == nil {
+					t.Errorf("expected an error, got %q", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if path != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, path)
+			}
+		})
+	}
+
+	resolved, err := ResolvePath(root, "/usr/bin/less")
+	if err != nil || resolved != "/bin/busybox" {
+		t.Errorf("expected /usr/bin/less to resolve to /bin/busybox, got %q (%v)", resolved, err)
+	}
+}
+
+func TestNewSystem(t *testing.T) {
+	s, err := NewSystem("rocky", "9.4", values.ArchARM64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Distro != values.RockyLinux || s.Family != values.RedHatFamily || s.Version != "9.4" || s.Arch != values.ArchARM64 {
+		t.Errorf("unexpected system %+v", s)
+	}
+
+	if _, err = NewSystem("rhel-like", "9.4", values.ArchAMD64); err == nil {
+		t.Errorf("expected an error for an unknown distro")
+	}
+	if _, err = NewSystem("rocky", "9.4", values.Architecture("x86_64")); err == nil {
+		t.Errorf("expected an error for an unknown arch")
+	}
+}
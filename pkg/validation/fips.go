@@ -0,0 +1,71 @@
+package validation
+
+import (
+	"debug/buildinfo"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// fipsBinaries are the kairos Go binaries that have a FIPS build, edgevpn has none
+var fipsBinaries = []string{"kairos-agent", "immucore", "kcrypt-discovery-challenger"}
+
+// fipsProviderBinaries are the FIPS binaries of the standard images
+var fipsProviderBinaries = []string{"agent-provider-kairos"}
+
+// fipsExperiments are the GOEXPERIMENT values that swap the Go crypto for a FIPS module: BoringCrypto upstream and
+// OpenSSL or CNG in the Microsoft and Red Hat toolchains
+var fipsExperiments = []string{"boringcrypto", "systemcrypto", "opensslcrypto", "cngcrypto"}
+
+// fipsModule returns the FIPS crypto module the Go binary was built with, if any
+func fipsModule(info *buildinfo.BuildInfo) (string, bool) {
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "GOFIPS140":
+			// The native Go Cryptographic Module, since Go 1.24
+			if s.Value != "" && s.Value != "off" {
+				return "GOFIPS140=" + s.Value, true
+			}
+		case "GOEXPERIMENT":
+			for _, experiment := range strings.Split(s.Value, ",") {
+				if slices.Contains(fipsExperiments, experiment) {
+					return experiment, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// ValidateFips checks that the kairos Go binaries found in searchPath were built with a FIPS crypto module
+func (v *Validator) ValidateFips(searchPath []string) error {
+	var multi *multierror.Error
+
+	binaries := fipsBinaries
+	if config.DefaultConfig.Variant == "standard" {
+		binaries = append(slices.Clone(binaries), fipsProviderBinaries...)
+	}
+	for _, binary := range binaries {
+		path, err := v.lookPath(binary, searchPath)
+		if err != nil {
+			// Missing binaries are already reported by the binaries check
+			continue
+		}
+		info, err := buildinfo.ReadFile(v.path(path))
+		if err != nil {
+			multi = multierror.Append(multi, fmt.Errorf("[FIPS] could not read the Go build info of %s: %s", binary, err))
+			continue
+		}
+		module, ok := fipsModule(info)
+		if !ok {
+			multi = multierror.Append(multi, fmt.Errorf("[FIPS] binary %s was not built with a FIPS crypto module", binary))
+			continue
+		}
+		v.Log.Logger.Info().Str("binary", binary).Str("module", module).Msg("[FIPS] Binary was built with a FIPS crypto module")
+	}
+
+	return multi.ErrorOrNil()
+}
@@ -0,0 +1,72 @@
+package validation
+
+import (
+	"debug/buildinfo"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+func TestFipsModule(t *testing.T) {
+	for _, tc := range []struct {
+		settings []debug.BuildSetting
+		module   string
+	}{
+		{[]debug.BuildSetting{{Key: "GOEXPERIMENT", Value: "boringcrypto"}}, "boringcrypto"},
+		{[]debug.BuildSetting{{Key: "GOEXPERIMENT", Value: "loopvar,systemcrypto"}}, "systemcrypto"},
+		{[]debug.BuildSetting{{Key: "GOFIPS140", Value: "v1.0.0"}}, "GOFIPS140=v1.0.0"},
+		{[]debug.BuildSetting{{Key: "GOFIPS140", Value: "off"}, {Key: "CGO_ENABLED", Value: "0"}}, ""},
+		{nil, ""},
+	} {
+		module, ok := fipsModule(&buildinfo.BuildInfo{Settings: tc.settings})
+		if module != tc.module || ok != (tc.module != "") {
+			t.Errorf("fipsModule(%v) = %q, %t, expected %q", tc.settings, module, ok, tc.module)
+		}
+	}
+}
+
+func TestValidateFips(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Variant = config.CoreVariant
+
+	// The test binary is a Go binary built without a FIPS crypto module
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err = os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(root, "usr/bin/kairos-agent"), data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(root, "usr/bin/immucore"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Validator{Log: logger.NewKairosLogger("test", "error", false), Root: root}
+	err = v.ValidateFips([]string{"/usr/bin"})
+	if err == nil {
+		t.Fatal("expected the binaries without a FIPS crypto module to fail")
+	}
+	if !strings.Contains(err.Error(), "kairos-agent was not built with a FIPS crypto module") {
+		t.Errorf("expected kairos-agent to fail, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "could not read the Go build info of immucore") {
+		t.Errorf("expected immucore to fail, got %v", err)
+	}
+	if strings.Contains(err.Error(), "kcrypt-discovery-challenger") {
+		t.Errorf("expected the missing binaries to be left to the binaries check, got %v", err)
+	}
+}
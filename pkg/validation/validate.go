@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
@@ -27,14 +28,78 @@ var defaultSystemdSearchPaths = []string{
 type Validator struct {
 	Log    logger.KairosLogger
 	System values.System
+	Root   string // Root of the system to validate, empty or / for the running system
 }
 
 func NewValidator(logger logger.KairosLogger) *Validator {
-	sis := system.DetectSystem(logger)
-	return &Validator{Log: logger, System: sis}
+	sis := system.DetectSystem(config.RootPath("/"), logger)
+	v := &Validator{Log: logger, System: sis}
+	// Root stays empty for the running system, so its PATH is used to look for the binaries
+	if config.HasRoot() {
+		v.Root = config.DefaultConfig.Root
+	}
+	return v
+}
+
+// path returns where the given path of the validated system is found in the running system
+func (v *Validator) path(p string) string {
+	if v.Root == "" {
+		return p
+	}
+	return filepath.Join(v.Root, p)
+}
+
+// root returns the root of the validated system
+func (v *Validator) root() string {
+	if v.Root == "" {
+		return "/"
+	}
+	return v.Root
+}
+
+// The files Validate looks for besides the binaries
+const (
+	kernelFile = "/boot/vmlinuz"
+	initrdFile = "/boot/initrd"
+)
+
+// requirement is a binary or file Validate looks for that is installed by the distro packages, with the packages
+// that provide it
+type requirement struct {
+	path     string
+	packages []string
+}
+
+// packageBinaries are the binaries Validate looks for that come from the distro packages
+var packageBinaries = []requirement{
+	{path: "sudo", packages: []string{"sudo"}},
+	{path: "less", packages: []string{"less"}},
+	{path: "mount.nfs", packages: []string{"nfs-common", "nfs-client", "nfs-utils"}},
+}
+
+// packageFiles are the files Validate looks for that come from the distro packages
+// The initrd is built with dracut, so dracut stands for it
+var packageFiles = []requirement{
+	{path: kernelFile, packages: []string{"kernel", "kernel-default", "kernel-uek", "linux-lts", "linux-raspi", "linux-rpi", "nvidia-l4t-kernel"}},
+	{path: initrdFile, packages: []string{"dracut"}},
 }
 
-// TODO: Validate fips, if enabled, check go binaries for boringcrypto
+// kernelPackagePrefix covers the kernel packages of Debian and Ubuntu for every arch and hwe version
+const kernelPackagePrefix = "linux-image-"
+
+// PackageRequirements returns the binaries and files Validate looks for that the package provides
+func PackageRequirements(pkg string) []string {
+	if strings.HasPrefix(pkg, kernelPackagePrefix) {
+		return []string{kernelFile}
+	}
+	var paths []string
+	for _, r := range append(slices.Clone(packageBinaries), packageFiles...) {
+		if slices.Contains(r.packages, pkg) {
+			paths = append(paths, r.path)
+		}
+	}
+	return paths
+}
 
 func (v *Validator) Validate() error {
 	var multi *multierror.Error
@@ -42,20 +107,21 @@ func (v *Validator) Validate() error {
 	binaries := []string{
 		"immucore",
 		"kairos-agent",
-		"sudo",
-		"less",
 		"kcrypt-discovery-challenger",
 	}
-	// Why do we check for "mount.nfs" ?? Is it that required somehow? Do we consider part of the requirements
-	if v.System.Family != values.HadronFamily {
-		binaries = append(binaries, "mount.nfs")
+	for _, r := range packageBinaries {
+		// Why do we check for "mount.nfs" ?? Is it that required somehow? Do we consider part of the requirements
+		if r.path == "mount.nfs" && v.System.Family == values.HadronFamily {
+			continue
+		}
+		binaries = append(binaries, r.path)
 	}
 
 	if config.DefaultConfig.Variant == "standard" {
 		binaries = append(binaries, "agent-provider-kairos", "kairos", "edgevpn")
 	}
 
-	vals, err := godotenv.Read("/etc/kairos-release")
+	vals, err := godotenv.Read(v.path("/etc/kairos-release"))
 	if err == nil {
 		provider := vals["KAIROS_SOFTWARE_VERSION"]
 		switch provider {
@@ -66,18 +132,21 @@ func (v *Validator) Validate() error {
 		}
 	}
 
-	// Alter path to include our providers path
-	originalPath := os.Getenv("PATH")
-	_ = os.Setenv("PATH", fmt.Sprintf("%s:%s:%s", "/system/providers/", "/system/discovery/", originalPath))
+	// Look in our providers path as well
+	searchPath := append([]string{"/system/providers/", "/system/discovery/"}, filepath.SplitList(os.Getenv("PATH"))...)
+	if v.Root != "" {
+		// The PATH of the running system has nothing to do with the validated one
+		searchPath = append([]string{"/system/providers/", "/system/discovery/"}, filepath.SplitList(system.DefaultPath)...)
+	}
 	// Check binaries
 	for _, binary := range binaries {
-		path, err := exec.LookPath(binary)
+		path, err := v.lookPath(binary, searchPath)
 		if err != nil {
 			multi = multierror.Append(multi, fmt.Errorf("[BINARIES] could not find binary %s", binary))
 		} else {
 			v.Log.Logger.Info().Str("path", path).Str("binary", binary).Msg("[BINARIES] Found binary")
 			// Check if the binary is executable
-			info, err := os.Stat(path)
+			info, err := os.Stat(v.path(path))
 			if err != nil {
 				multi = multierror.Append(multi, fmt.Errorf("[BINARIES] could not stat binary %s: %s", binary, err))
 			}
@@ -89,23 +158,31 @@ func (v *Validator) Validate() error {
 		}
 	}
 
-	// Restore the path
-	_ = os.Setenv("PATH", originalPath)
+	// FIPS images need the kairos binaries built with a FIPS crypto module, not just the FIPS kernel and initrd
+	if config.DefaultConfig.Fips || vals["KAIROS_FIPS"] == "true" {
+		if err := v.ValidateFips(searchPath); err != nil {
+			multi = multierror.Append(multi, err)
+		}
+	}
 
-	checkFiles := []string{"/boot/vmlinuz"}
-	if !config.DefaultConfig.TrustedBoot {
-		checkFiles = append(checkFiles, "/boot/initrd")
+	var checkFiles []string
+	for _, r := range packageFiles {
+		// Trusted boot images have the initrd in the UKI
+		if r.path == initrdFile && config.DefaultConfig.TrustedBoot {
+			continue
+		}
+		checkFiles = append(checkFiles, r.path)
 	}
 	for _, f := range checkFiles {
-		s, err := os.Lstat(f)
+		s, err := os.Lstat(v.path(f))
 		if err != nil {
 			multi = multierror.Append(multi, fmt.Errorf("[FILES] file missing %s", f))
 			continue
 		}
 		v.Log.Logger.Info().Str("file", f).Msg("Found file")
 		// Check if its a symlink in the vmlinuz case
-		if s != nil && s.Mode()&os.ModeSymlink != 0 && f == "/boot/vmlinuz" {
-			if err := validateBootFileSymlink(f); err != nil {
+		if s != nil && s.Mode()&os.ModeSymlink != 0 && f == kernelFile {
+			if err := validateBootFileSymlink(v.root(), f); err != nil {
 				multi = multierror.Append(multi, err)
 				continue
 			}
@@ -133,7 +210,7 @@ func (v *Validator) Validate() error {
 		"KAIROS_RELEASE",
 	}
 
-	vals, err = godotenv.Read("/etc/kairos-release")
+	vals, err = godotenv.Read(v.path("/etc/kairos-release"))
 	if err != nil {
 		multi = multierror.Append(multi, fmt.Errorf("[RELEASE] could not open kairos-release file"))
 	} else {
@@ -159,7 +236,7 @@ func (v *Validator) Validate() error {
 	ExpectedDirs := []string{"/var/lock"}
 
 	for _, dir := range ExpectedDirs {
-		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		if _, err := os.Lstat(v.path(dir)); os.IsNotExist(err) {
 			multi = multierror.Append(multi, fmt.Errorf("[DIRS] directory %s does not exist", dir))
 		}
 	}
@@ -172,7 +249,7 @@ func (v *Validator) Validate() error {
 			v.Log.Logger.Warn().Msg("[INITRD] lsinitrd not found, cannot check initrd contents")
 		} else {
 			v.Log.Logger.Info().Msg("Checking initrd contents")
-			out, err := exec.Command("lsinitrd", "/boot/initrd").CombinedOutput()
+			out, err := exec.Command("lsinitrd", v.path("/boot/initrd")).CombinedOutput()
 			if err != nil {
 				multi = multierror.Append(multi, fmt.Errorf("[INITRD] failed checking initrd contents: %s", err))
 			}
@@ -211,7 +288,7 @@ func (v *Validator) Validate() error {
 	}
 
 	// Check if there are any ssh host keys in /etc/ssh
-	matches, err := filepath.Glob("/etc/ssh/ssh_host_*_key")
+	matches, err := filepath.Glob(v.path("/etc/ssh/ssh_host_*_key"))
 	if err != nil {
 		multi = multierror.Append(multi, fmt.Errorf("[SSH] error checking for SSH host keys: %s", err))
 	}
@@ -260,7 +337,7 @@ func (v *Validator) ValidateServices() error {
 func (v *Validator) lookupSystemdServiceFile(serviceName string, searchPaths []string) (string, error) {
 	for _, path := range searchPaths {
 		servicePath := filepath.Join(path, serviceName)
-		if _, err := os.Stat(servicePath); err == nil {
+		if _, err := os.Stat(v.path(servicePath)); err == nil {
 			return servicePath, nil
 		}
 	}
@@ -297,7 +374,7 @@ func (v *Validator) ValidateRHELServicesWithPaths(searchPaths []string) error {
 		}
 
 		// Check if the service is masked (symlink to /dev/null)
-		if target, err := os.Readlink(servicePath); err == nil && target == "/dev/null" {
+		if target, err := os.Readlink(v.path(servicePath)); err == nil && target == "/dev/null" {
 			multi = multierror.Append(multi, fmt.Errorf("[SERVICES] service %s is masked on RHEL family system", service))
 		} else {
 			v.Log.Logger.Info().Str("service", service).Msg("Service exists and is not masked")
@@ -314,7 +391,7 @@ func (v *Validator) ValidateGettyServices() error {
 
 // ValidateKernel checks that the kernel chooser can find a valid kernel under /lib/modules.
 func (v *Validator) ValidateKernel() error {
-	return v.ValidateKernelWithPath("/lib/modules", config.DefaultConfig.Model)
+	return v.ValidateKernelWithPath(v.path("/lib/modules"), config.DefaultConfig.Model)
 }
 
 // ValidateKernelWithPath checks that the kernel chooser can find a valid kernel in the given
@@ -330,21 +407,21 @@ func (v *Validator) ValidateKernelWithPath(modulesPath, model string) error {
 	return nil
 }
 
-// validateBootFileSymlink checks that a boot symlink resolves to an existing file.
+// validateBootFileSymlink checks that a boot symlink resolves to an existing file inside root.
 // Relative targets (e.g. Debian riscv64 vmlinux-* links) are resolved from the
 // symlink directory, not the process working directory.
-func validateBootFileSymlink(linkPath string) error {
-	target, err := os.Readlink(linkPath)
+func validateBootFileSymlink(root, linkPath string) error {
+	target, err := os.Readlink(filepath.Join(root, linkPath))
 	if err != nil {
 		return fmt.Errorf("%s symlink is not a valid symlink", linkPath)
 	}
 
-	resolved, err := filepath.EvalSymlinks(linkPath)
+	resolved, err := system.ResolvePath(root, linkPath)
 	if err != nil {
 		return fmt.Errorf("[FILES] symlink %s points to a non-existent file %s", linkPath, target)
 	}
 
-	if _, err = os.Stat(resolved); os.IsNotExist(err) {
+	if _, err = os.Stat(filepath.Join(root, resolved)); os.IsNotExist(err) {
 		return fmt.Errorf("[FILES] symlink %s points to a non-existent file %s", linkPath, target)
 	}
 
@@ -374,7 +451,7 @@ func (v *Validator) ValidateGettyServicesWithPaths(searchPaths []string) error {
 		}
 
 		// Check if the service is masked (symlink to /dev/null)
-		if target, err := os.Readlink(servicePath); err == nil && target == "/dev/null" {
+		if target, err := os.Readlink(v.path(servicePath)); err == nil && target == "/dev/null" {
 			multi = multierror.Append(multi, fmt.Errorf("[SERVICES] service %s is masked on systemd-based system", service))
 		} else {
 			v.Log.Logger.Info().Str("service", service).Msg("Service exists and is not masked")
@@ -383,3 +460,8 @@ func (v *Validator) ValidateGettyServicesWithPaths(searchPaths []string) error {
 
 	return multi.ErrorOrNil()
 }
+
+// lookPath searches for the binary in the given dirs of the validated system
+func (v *Validator) lookPath(binary string, dirs []string) (string, error) {
+	return system.LookPath(v.root(), binary, dirs)
+}
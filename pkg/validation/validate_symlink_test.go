@@ -18,7 +18,7 @@ func TestValidateBootFileSymlink(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := validateBootFileSymlink(link); err != nil {
+		if err := validateBootFileSymlink("/", link); err != nil {
 			t.Fatalf("expected relative symlink to validate, got: %v", err)
 		}
 	})
@@ -30,7 +30,7 @@ func TestValidateBootFileSymlink(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := validateBootFileSymlink(link); err == nil {
+		if err := validateBootFileSymlink("/", link); err == nil {
 			t.Fatal("expected error for broken symlink")
 		}
 	})
@@ -46,8 +46,29 @@ func TestValidateBootFileSymlink(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := validateBootFileSymlink(link); err != nil {
+		if err := validateBootFileSymlink("/", link); err != nil {
 			t.Fatalf("expected absolute symlink to validate, got: %v", err)
 		}
 	})
+
+	t.Run("absolute target inside a root", func(t *testing.T) {
+		root := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(root, "boot"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "boot", "vmlinuz-6.1.0"), []byte("kernel"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// The target is absolute for the root, it doesn't exist in the running system
+		if err := os.Symlink("/boot/vmlinuz-6.1.0", filepath.Join(root, "boot", "vmlinuz")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := validateBootFileSymlink(root, "/boot/vmlinuz"); err != nil {
+			t.Fatalf("expected absolute symlink to resolve inside the root, got: %v", err)
+		}
+		if err := validateBootFileSymlink("/", filepath.Join(root, "boot", "vmlinuz")); err == nil {
+			t.Fatal("expected the link to be broken outside of the root")
+		}
+	})
 }
@@ -26,6 +26,20 @@ var _ = Describe("Validator", func() {
 			Expect(validator).NotTo(BeNil())
 			Expect(validator.Log).To(Equal(logger))
 			Expect(validator.System).NotTo(BeNil())
+			// Without --root the running system is validated, with its own PATH
+			Expect(validator.Root).To(BeEmpty())
+		})
+	})
+
+	Describe("PackageRequirements", func() {
+		It("should return what the validator looks for in the package", func() {
+			Expect(validation.PackageRequirements("sudo")).To(Equal([]string{"sudo"}))
+			Expect(validation.PackageRequirements("nfs-utils")).To(Equal([]string{"mount.nfs"}))
+			Expect(validation.PackageRequirements("dracut")).To(Equal([]string{"/boot/initrd"}))
+			Expect(validation.PackageRequirements("kernel-default")).To(Equal([]string{"/boot/vmlinuz"}))
+			Expect(validation.PackageRequirements("linux-image-generic-hwe-24.04")).To(Equal([]string{"/boot/vmlinuz"}))
+			Expect(validation.PackageRequirements("nano")).To(BeEmpty())
+			Expect(validation.PackageRequirements("less")).To(Equal([]string{"less"}))
 		})
 	})
 
@@ -2,6 +2,9 @@ package values
 
 import (
 	"bytes"
+	"fmt"
+	"slices"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -1172,135 +1175,234 @@ func PackageListToTemplate(packages []string, params map[string]string, l logger
 	return finalPackages, nil
 }
 
+// PackageGroup is a list of packages coming from one entry of the package maps
+type PackageGroup struct {
+	Map        string       `json:"map" yaml:"map"`                         // Name of the package map, same as in the package overlays
+	Key        string       `json:"key,omitempty" yaml:"key,omitempty"`     // Distro or family of the entry
+	Arch       Architecture `json:"arch,omitempty" yaml:"arch,omitempty"`   // Arch of the entry, common for both arches
+	Model      Model        `json:"model,omitempty" yaml:"model,omitempty"` // Only set for the model maps
+	Constraint string       `json:"constraint" yaml:"constraint"`           // Constraint that matched the system version
+	Packages   []string     `json:"packages" yaml:"packages"`
+}
+
+// String describes where the packages come from, like: base[rocky/arm64] ">=9"
+func (g PackageGroup) String() string {
+	var where []string
+	for _, k := range []string{g.Key, g.Arch.String(), g.Model.String()} {
+		if k != "" {
+			where = append(where, k)
+		}
+	}
+	if len(where) == 0 {
+		return g.Map
+	}
+	return fmt.Sprintf("%s[%s] %q", g.Map, strings.Join(where, "/"), g.Constraint)
+}
+
+// TemplatePackageGroups returns the groups with their packages rendered with the params, see PackageListToTemplate
+func TemplatePackageGroups(groups []PackageGroup, params map[string]string, l logger.KairosLogger) ([]PackageGroup, error) {
+	result := make([]PackageGroup, 0, len(groups))
+	for _, g := range groups {
+		pkgs, err := PackageListToTemplate(g.Packages, params, l)
+		if err != nil {
+			return nil, err
+		}
+		g.Packages = pkgs
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+// PackageGroupsWith returns the groups that include the package
+func PackageGroupsWith(groups []PackageGroup, pkg string) []PackageGroup {
+	var result []PackageGroup
+	for _, g := range groups {
+		if slices.Contains(g.Packages, pkg) {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// packageSource is an entry of the package maps, to be filtered on the system version
+type packageSource struct {
+	name     string
+	key      DistroFamilyInterface
+	arch     Architecture
+	model    Model
+	versions VersionMap
+}
+
+// mapSources returns the entries of the map for the distro and family of the system, both the common and arch ones
+func mapSources(name string, m PackageMap, s System) []packageSource {
+	return []packageSource{
+		{name: name, key: s.Distro, arch: ArchCommon, versions: m[s.Distro][ArchCommon]}, // Common packages to both arches
+		{name: name, key: s.Family, arch: ArchCommon, versions: m[s.Family][ArchCommon]}, // Common packages to both arches by family
+		{name: name, key: s.Distro, arch: s.Arch, versions: m[s.Distro][s.Arch]},         // Specific packages for the arch
+		{name: name, key: s.Family, arch: s.Arch, versions: m[s.Family][s.Arch]},         // Specific packages for the arch by family
+	}
+}
+
+// modelMapSources returns the entries of the model map for the distro and family of the system and the model
+func modelMapSources(name string, m ModelPackageMap, s System, model Model) []packageSource {
+	return []packageSource{
+		{name: name, key: s.Distro, arch: ArchCommon, model: model, versions: m[s.Distro][ArchCommon][model]},
+		{name: name, key: s.Family, arch: ArchCommon, model: model, versions: m[s.Family][ArchCommon][model]},
+		{name: name, key: s.Distro, arch: s.Arch, model: model, versions: m[s.Distro][s.Arch][model]},
+		{name: name, key: s.Family, arch: s.Arch, model: model, versions: m[s.Family][s.Arch][model]},
+	}
+}
+
+// kernelMapSources returns the entries of the kernel map for the system. The family entries are only used if the
+// distro has no entries of its own
+func kernelMapSources(name string, m PackageMap, s System) []packageSource {
+	distroKernel := m[s.Distro]
+	hasDistroOverride := distroKernel != nil && (distroKernel[ArchCommon] != nil || distroKernel[s.Arch] != nil)
+	sources := []packageSource{
+		{name: name, key: s.Distro, arch: ArchCommon, versions: m[s.Distro][ArchCommon]}, // Common kernel packages to both arches
+		{name: name, key: s.Distro, arch: s.Arch, versions: m[s.Distro][s.Arch]},         // Specific kernel packages for the arch
+	}
+	if !hasDistroOverride {
+		sources = append(sources,
+			packageSource{name: name, key: s.Family, arch: ArchCommon, versions: m[s.Family][ArchCommon]}, // Common kernel packages to both arches by family
+			packageSource{name: name, key: s.Family, arch: s.Arch, versions: m[s.Family][s.Arch]},         // Specific kernel packages for the arch by family
+		)
+	}
+	return sources
+}
+
 func GetPackages(s System, l logger.KairosLogger) ([]string, error) {
-	mergedPkgs := CommonPackages
+	groups, err := GetPackageGroups(s, l)
+	if err != nil {
+		return nil, err
+	}
+	return MergePackageGroups(groups), nil
+}
+
+// GetPackageGroups returns the base packages for the system grouped by the entry of the package maps they come from
+func GetPackageGroups(s System, l logger.KairosLogger) ([]PackageGroup, error) {
+	groups := []PackageGroup{{Map: "common", Constraint: Common, Packages: slices.Clone(CommonPackages)}}
+	l.Logger.Debug().Str("map", "common").Strs("packages", CommonPackages).Msg("Adding packages")
 
 	// Go over all packages maps
-	filteredPackages := []VersionMap{
-		BasePackages[s.Distro][ArchCommon], // Common packages to both arches
-		BasePackages[s.Family][ArchCommon], // Common packages to both arches by family
-		BasePackages[s.Distro][s.Arch],     // Specific packages for the arch
-		BasePackages[s.Family][s.Arch],     // Specific packages for the arch by family
-	}
+	sources := mapSources("base", BasePackages, s)
 	// Include model-specific base packages when model is not generic
 	if config.DefaultConfig.Model != Generic.String() {
-		filteredPackages = append(filteredPackages, BasePackagesModels[s.Distro][ArchCommon][Model(config.DefaultConfig.Model)])
-		filteredPackages = append(filteredPackages, BasePackagesModels[s.Family][ArchCommon][Model(config.DefaultConfig.Model)])
-		filteredPackages = append(filteredPackages, BasePackagesModels[s.Distro][s.Arch][Model(config.DefaultConfig.Model)])
-		filteredPackages = append(filteredPackages, BasePackagesModels[s.Family][s.Arch][Model(config.DefaultConfig.Model)])
+		sources = append(sources, modelMapSources("base_models", BasePackagesModels, s, Model(config.DefaultConfig.Model))...)
 	}
 	// If trusted boot is enabled, we need to install the trusted boot packages
 	if config.DefaultConfig.TrustedBoot {
 		// Install only systemd-boot packages
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Family][s.Arch])
+		sources = append(sources, mapSources("systemd", SystemdPackages, s)...)
 	} else {
 		// install grub and immucore packages
-		filteredPackages = append(filteredPackages, GrubPackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Family][s.Arch])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Family][s.Arch])
+		sources = append(sources, mapSources("grub", GrubPackages, s)...)
+		sources = append(sources, mapSources("immucore", ImmucorePackages, s)...)
 	}
 
-	mergedPkgs = append(mergedPkgs, FilterPackagesOnConstraint(s, l, filteredPackages)...)
-
-	return mergedPkgs, nil
+	filtered, err := filterSourcesOnConstraint(s, l, sources)
+	if err != nil {
+		return nil, err
+	}
+	return append(groups, filtered...), nil
 }
 
 func GetKernelPackages(s System, l logger.KairosLogger) ([]string, error) {
+	groups, err := GetKernelPackageGroups(s, l)
+	if err != nil {
+		return nil, err
+	}
+	return MergePackageGroups(groups), nil
+}
+
+// GetKernelPackageGroups returns the kernel packages for the system grouped by the entry of the package maps they
+// come from
+func GetKernelPackageGroups(s System, l logger.KairosLogger) ([]PackageGroup, error) {
 	// Get the kernel packages for the system
-	var filteredPackages []VersionMap
+	var sources []packageSource
 
-	if config.DefaultConfig.TrustedBoot {
-		// Kernel packages by model
-		if config.DefaultConfig.Model == Generic.String() {
-			distroKernel := KernelPackagesTrustedBoot[s.Distro]
-			hasDistroOverride := distroKernel != nil && (distroKernel[ArchCommon] != nil || distroKernel[s.Arch] != nil)
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Distro][ArchCommon]) // Common kernel packages to both arches
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Distro][s.Arch])     // Specific kernel packages for the arch
-			if !hasDistroOverride {
-				filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Family][ArchCommon]) // Common kernel packages to both arches by family
-				filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Family][s.Arch])     // Specific kernel packages for the arch by family
-			}
+	if config.DefaultConfig.Model == Generic.String() {
+		if config.DefaultConfig.TrustedBoot {
+			sources = kernelMapSources("kernel_trusted_boot", KernelPackagesTrustedBoot, s)
 		} else {
-			// Get specific packages for the model
-			// TODO: No support for trusted boot on models yet, so this part is probably useless for now?
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][s.Arch][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][s.Arch][Model(config.DefaultConfig.Model)])
+			sources = kernelMapSources("kernel", KernelPackages, s)
 		}
 	} else {
-		if config.DefaultConfig.Model == Generic.String() {
-			distroKernel := KernelPackages[s.Distro]
-			hasDistroOverride := distroKernel != nil && (distroKernel[ArchCommon] != nil || distroKernel[s.Arch] != nil)
-			filteredPackages = append(filteredPackages, KernelPackages[s.Distro][ArchCommon]) // Common kernel packages to both arches
-			filteredPackages = append(filteredPackages, KernelPackages[s.Distro][s.Arch])     // Specific kernel packages for the arch
-			if !hasDistroOverride {
-				filteredPackages = append(filteredPackages, KernelPackages[s.Family][ArchCommon]) // Common kernel packages to both arches by family
-				filteredPackages = append(filteredPackages, KernelPackages[s.Family][s.Arch])     // Specific kernel packages for the arch by family
-			}
-		} else {
-			// Get specific packages for the model
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][s.Arch][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][s.Arch][Model(config.DefaultConfig.Model)])
-		}
+		// Get specific packages for the model
+		// TODO: No support for trusted boot on models yet, so for trusted boot this part is probably useless for now?
+		sources = modelMapSources("kernel_models", KernelPackagesModels, s, Model(config.DefaultConfig.Model))
 	}
 	// Return filtered packages
-	return FilterPackagesOnConstraint(s, l, filteredPackages), nil
+	return filterSourcesOnConstraint(s, l, sources)
 }
 
-// FilterPackagesOnConstraint filters the packages based on the system version and the constraints in the package map
-func FilterPackagesOnConstraint(s System, l logger.KairosLogger, pkgsToFilter []VersionMap) []string {
-	// Go over each list of packages
+// MergePackageGroups returns the packages of all the groups, in order
+func MergePackageGroups(groups []PackageGroup) []string {
 	var pkgs []string
-	systemVersion, err := semver.NewVersion(s.Version)
+	for _, g := range groups {
+		pkgs = append(pkgs, g.Packages...)
+	}
+	return pkgs
+}
+
+// filterSourcesOnConstraint returns a group for each constraint of the sources that matches the system version
+// The common constraint goes first and the rest are sorted, so the result is always the same
+// Common packages always apply, even to systems without a version, but a version that can't be parsed is an error, so
+// the packages for it are never silently left out
+func filterSourcesOnConstraint(s System, l logger.KairosLogger, sources []packageSource) ([]PackageGroup, error) {
+	var groups []PackageGroup
+	systemVersion, err := s.ParseVersion()
 	if err != nil {
-		return pkgs
+		return groups, err
 	}
-	for _, packages := range pkgsToFilter {
-		// for each package map, check if the version matches the constraint
-		for constraint, values := range packages {
-			// Add them if they are common
-			l.Logger.Debug().Str("constraint", constraint).Str("version", systemVersion.String()).Msg("Checking constraint")
-			if constraint == Common {
-				l.Logger.Debug().Strs("packages", values).Msg("Adding common packages")
-				pkgs = append(pkgs, values...)
-				continue
+	scheme := s.VersionScheme()
+	for _, source := range sources {
+		constraints := make([]string, 0, len(source.versions))
+		for constraint := range source.versions {
+			constraints = append(constraints, constraint)
+		}
+		sort.Slice(constraints, func(i, j int) bool {
+			if constraints[i] == Common || constraints[j] == Common {
+				return constraints[i] == Common && constraints[j] != Common
 			}
-
-			// if the constraint has "||" it means we have multiple constraints, so we split them
-			// as we validate each constraint independently like an OR operation
-			// otherwise just treat it as AND and leave it as is, a single constraint
-			// This is because the underlying lib does not handle OR easily so we do it ourselves
-			var constraintList []string
-			if strings.Contains(constraint, "||") {
-				constraintList = strings.Split(constraint, "||")
-			} else {
-				constraintList = []string{constraint}
+			return constraints[i] < constraints[j]
+		})
+		for _, constraint := range constraints {
+			if !matchConstraint(constraint, scheme, systemVersion, l) {
+				continue
 			}
-			for _, c := range constraintList {
-				c = strings.TrimSpace(c)
-				semverConstraint, err := semver.NewConstraint(c)
-				if err != nil {
-					l.Logger.Error().Err(err).Str("constraint", c).Msg("Error parsing constraint.")
-					continue
-				}
-				if semverConstraint.Check(systemVersion) {
-					l.Logger.Debug().Strs("packages", values).Msg("Constraint matches, adding packages")
-					pkgs = append(pkgs, values...)
-					break
-				}
+			g := PackageGroup{
+				Map:        source.name,
+				Key:        fmt.Sprint(source.key),
+				Arch:       source.arch,
+				Model:      source.model,
+				Constraint: constraint,
+				Packages:   slices.Clone(source.versions[constraint]),
 			}
+			l.Logger.Debug().Str("map", g.Map).Str("key", g.Key).Str("arch", g.Arch.String()).Str("model", g.Model.String()).
+				Str("constraint", g.Constraint).Strs("packages", g.Packages).Msg("Adding packages")
+			groups = append(groups, g)
 		}
 	}
-	return pkgs
+	return groups, nil
+}
+
+// matchConstraint returns true if the constraint of a package map matches the system version
+// Systems without a version only match the common constraint
+func matchConstraint(constraint string, scheme VersionScheme, systemVersion *semver.Version, l logger.KairosLogger) bool {
+	// Add them if they are common
+	l.Logger.Debug().Str("constraint", constraint).Str("scheme", string(scheme)).Msg("Checking constraint")
+	if constraint == Common {
+		return true
+	}
+	pc, err := parseConstraint(constraint)
+	if err != nil {
+		l.Logger.Error().Err(err).Str("constraint", constraint).Msg("Error parsing constraint.")
+		return false
+	}
+	if pc.check(scheme, systemVersion) {
+		l.Logger.Debug().Str("constraint", constraint).Msg("Constraint matches")
+		return true
+	}
+	return false
 }
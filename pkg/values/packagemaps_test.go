@@ -35,3 +35,76 @@ func TestThorKernelPackagesIncludeBootloader(t *testing.T) {
 	t.Fatalf("Thor kernel packages must include nvidia-l4t-bootloader "+
 		"(needed for the QSPI capsule payload and version); got %v", pkgs)
 }
+
+func TestGetPackageGroups(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Model = Generic.String()
+	config.DefaultConfig.TrustedBoot = true
+
+	l := logger.NewKairosLogger("test", "error", false)
+	sis := System{Distro: RockyLinux, Family: RedHatFamily, Version: "9.4", Arch: ArchARM64}
+	groups, err := GetPackageGroups(sis, l)
+	if err != nil {
+		t.Fatalf("GetPackageGroups: %v", err)
+	}
+	if groups[0].Map != "common" || len(groups[0].Packages) != len(CommonPackages) {
+		t.Errorf("expected the common packages first, got %+v", groups[0])
+	}
+	var matched []string
+	for _, g := range groups {
+		if g.Map == "grub" || g.Map == "immucore" {
+			t.Errorf("expected no grub or immucore packages with trusted boot, got %+v", g)
+		}
+		if g.Map == "base" && g.Key == RedHatFamily.String() {
+			matched = append(matched, g.Constraint)
+		}
+	}
+	if len(matched) != 2 || matched[0] != Common || matched[1] != ">=9.0" {
+		t.Errorf("expected the common and >=9.0 constraints of the redhat family, got %v", matched)
+	}
+
+	pkgs, err := GetPackages(sis, l)
+	if err != nil {
+		t.Fatalf("GetPackages: %v", err)
+	}
+	if len(pkgs) != len(MergePackageGroups(groups)) {
+		t.Errorf("expected the packages of all the groups, got %v", pkgs)
+	}
+
+	kernel, err := GetKernelPackageGroups(sis, l)
+	if err != nil {
+		t.Fatalf("GetKernelPackageGroups: %v", err)
+	}
+	if len(kernel) == 0 || kernel[0].Map != "kernel_trusted_boot" {
+		t.Errorf("expected the trusted boot kernel packages, got %+v", kernel)
+	}
+}
+
+func TestPackageGroupsWith(t *testing.T) {
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Model = Generic.String()
+
+	l := logger.NewKairosLogger("test", "error", false)
+	sis := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Arch: ArchAMD64}
+	groups, err := GetKernelPackageGroups(sis, l)
+	if err != nil {
+		t.Fatalf("GetKernelPackageGroups: %v", err)
+	}
+	groups, err = TemplatePackageGroups(groups, GetTemplateParams(sis), l)
+	if err != nil {
+		t.Fatalf("TemplatePackageGroups: %v", err)
+	}
+
+	found := PackageGroupsWith(groups, "linux-image-generic-hwe-24.04")
+	if len(found) != 1 {
+		t.Fatalf("expected the kernel to come from a single entry, got %+v", found)
+	}
+	if got := found[0].String(); got != `kernel[ubuntu/amd64] "20.04 || 22.04 || 24.04 || 28.04"` {
+		t.Errorf("unexpected provenance %s", got)
+	}
+	if found = PackageGroupsWith(groups, "linux-image-generic-hwe-{{.version}}"); len(found) != 0 {
+		t.Errorf("expected only the rendered package names, got %+v", found)
+	}
+}
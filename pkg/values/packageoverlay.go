@@ -0,0 +1,276 @@
+package values
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PackageOverlay changes the package maps without a new kairos-init release, for example when a distro renames a
+// package. It has the same shape as the package maps, by map name:
+//
+//	base:
+//	  distro:
+//	    ubuntu:
+//	      amd64:
+//	        ">=24.04":
+//	          remove: [old-name]
+//	          add: [new-name]
+//	  family:
+//	    debian:
+//	      common:
+//	        common:
+//	          replace: [only, these]
+//	base_models:
+//	  distro:
+//	    ubuntu:
+//	      arm64:
+//	        rpi4:
+//	          common:
+//	            add: [extra]
+//	common:
+//	  add: [extra-everywhere]
+//
+// Distros and families are separate keys as some of them share a name, like debian.
+type PackageOverlay struct {
+	Common            *PackageChange    `yaml:"common,omitempty"` // CommonPackages
+	Base              PackageMapOverlay `yaml:"base,omitempty"`
+	BaseModels        ModelMapOverlay   `yaml:"base_models,omitempty"`
+	Kernel            PackageMapOverlay `yaml:"kernel,omitempty"`
+	KernelTrustedBoot PackageMapOverlay `yaml:"kernel_trusted_boot,omitempty"`
+	KernelModels      ModelMapOverlay   `yaml:"kernel_models,omitempty"`
+	Grub              PackageMapOverlay `yaml:"grub,omitempty"`
+	Systemd           PackageMapOverlay `yaml:"systemd,omitempty"`
+	Immucore          PackageMapOverlay `yaml:"immucore,omitempty"`
+}
+
+// PackageMapOverlay are the changes to a PackageMap by distro or family, arch and constraint
+type PackageMapOverlay struct {
+	Distro map[Distro]map[Architecture]map[string]PackageChange `yaml:"distro,omitempty"`
+	Family map[Family]map[Architecture]map[string]PackageChange `yaml:"family,omitempty"`
+}
+
+// ModelMapOverlay are the changes to a ModelPackageMap by distro or family, arch, model and constraint
+type ModelMapOverlay struct {
+	Distro map[Distro]map[Architecture]map[Model]map[string]PackageChange `yaml:"distro,omitempty"`
+	Family map[Family]map[Architecture]map[Model]map[string]PackageChange `yaml:"family,omitempty"`
+}
+
+// PackageChange changes a list of packages. Replace goes first, then remove and then add, so a package can be
+// renamed by removing the old name and adding the new one. An empty replace list removes all the packages.
+type PackageChange struct {
+	Replace *[]string `yaml:"replace,omitempty"`
+	Remove  []string  `yaml:"remove,omitempty"`
+	Add     []string  `yaml:"add,omitempty"`
+}
+
+// apply returns the packages with the change applied
+func (c PackageChange) apply(packages []string) []string {
+	result := slices.Clone(packages)
+	if c.Replace != nil {
+		result = slices.Clone(*c.Replace)
+	}
+	result = slices.DeleteFunc(result, func(p string) bool { return slices.Contains(c.Remove, p) })
+	for _, p := range c.Add {
+		if !slices.Contains(result, p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// LoadPackageOverlay reads a package overlay file, unknown keys, distros, families, arches, models and invalid
+// constraints are an error
+func LoadPackageOverlay(path string) (PackageOverlay, error) {
+	var overlay PackageOverlay
+	file, err := os.Open(path)
+	if err != nil {
+		return overlay, err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&overlay); err != nil && !errors.Is(err, io.EOF) {
+		return overlay, fmt.Errorf("failed to parse package overlay %s: %w", path, err)
+	}
+	if err = overlay.validate(); err != nil {
+		return overlay, fmt.Errorf("invalid package overlay %s: %w", path, err)
+	}
+	return overlay, nil
+}
+
+// ApplyPackageOverlays loads the overlay files and applies them to the package maps, in the given order
+func ApplyPackageOverlays(paths []string) error {
+	for _, path := range paths {
+		overlay, err := LoadPackageOverlay(path)
+		if err != nil {
+			return err
+		}
+		overlay.Apply()
+	}
+	return nil
+}
+
+// Apply changes the package maps with the overlay
+func (o PackageOverlay) Apply() {
+	if o.Common != nil {
+		CommonPackages = o.Common.apply(CommonPackages)
+	}
+	o.Base.apply(BasePackages)
+	o.BaseModels.apply(BasePackagesModels)
+	o.Kernel.apply(KernelPackages)
+	o.KernelTrustedBoot.apply(KernelPackagesTrustedBoot)
+	o.KernelModels.apply(KernelPackagesModels)
+	o.Grub.apply(GrubPackages)
+	o.Systemd.apply(SystemdPackages)
+	o.Immucore.apply(ImmucorePackages)
+}
+
+func (o PackageMapOverlay) apply(m PackageMap) {
+	for distro, arches := range o.Distro {
+		applyArches(m, distro, arches)
+	}
+	for family, arches := range o.Family {
+		applyArches(m, family, arches)
+	}
+}
+
+func (o ModelMapOverlay) apply(m ModelPackageMap) {
+	for distro, arches := range o.Distro {
+		applyModelArches(m, distro, arches)
+	}
+	for family, arches := range o.Family {
+		applyModelArches(m, family, arches)
+	}
+}
+
+func applyArches(m PackageMap, key DistroFamilyInterface, arches map[Architecture]map[string]PackageChange) {
+	if m[key] == nil {
+		m[key] = map[Architecture]VersionMap{}
+	}
+	for arch, constraints := range arches {
+		if m[key][arch] == nil {
+			m[key][arch] = VersionMap{}
+		}
+		applyConstraints(m[key][arch], constraints)
+	}
+}
+
+func applyModelArches(m ModelPackageMap, key DistroFamilyInterface, arches map[Architecture]map[Model]map[string]PackageChange) {
+	if m[key] == nil {
+		m[key] = map[Architecture]map[Model]VersionMap{}
+	}
+	for arch, models := range arches {
+		if m[key][arch] == nil {
+			m[key][arch] = map[Model]VersionMap{}
+		}
+		for model, constraints := range models {
+			if m[key][arch][model] == nil {
+				m[key][arch][model] = VersionMap{}
+			}
+			applyConstraints(m[key][arch][model], constraints)
+		}
+	}
+}
+
+func applyConstraints(m VersionMap, constraints map[string]PackageChange) {
+	for constraint, change := range constraints {
+		packages := change.apply(m[constraint])
+		if len(packages) == 0 {
+			delete(m, constraint)
+			continue
+		}
+		m[constraint] = packages
+	}
+}
+
+// validate checks the distros, families, arches, models and constraints of the overlay, so a typo doesn't silently
+// do nothing
+func (o PackageOverlay) validate() error {
+	maps := []PackageMapOverlay{o.Base, o.Kernel, o.KernelTrustedBoot, o.Grub, o.Systemd, o.Immucore}
+	modelMaps := []ModelMapOverlay{o.BaseModels, o.KernelModels}
+
+	var distros []Distro
+	var families []Family
+	var archs []Architecture
+	var models []Model
+	var constraints []string
+	for _, m := range maps {
+		distros = append(distros, mapKeys(m.Distro)...)
+		families = append(families, mapKeys(m.Family)...)
+		for _, byArch := range append(mapValues(m.Distro), mapValues(m.Family)...) {
+			archs = append(archs, mapKeys(byArch)...)
+			for _, byConstraint := range byArch {
+				constraints = append(constraints, mapKeys(byConstraint)...)
+			}
+		}
+	}
+	for _, m := range modelMaps {
+		distros = append(distros, mapKeys(m.Distro)...)
+		families = append(families, mapKeys(m.Family)...)
+		for _, byArch := range append(mapValues(m.Distro), mapValues(m.Family)...) {
+			archs = append(archs, mapKeys(byArch)...)
+			for _, byModel := range byArch {
+				models = append(models, mapKeys(byModel)...)
+				for _, byConstraint := range byModel {
+					constraints = append(constraints, mapKeys(byConstraint)...)
+				}
+			}
+		}
+	}
+
+	for _, distro := range distros {
+		if !slices.Contains(KnownDistros, distro) {
+			return fmt.Errorf("unknown distro %s", distro)
+		}
+	}
+	for _, family := range families {
+		if !slices.Contains(KnownFamilies, family) {
+			return fmt.Errorf("unknown family %s", family)
+		}
+	}
+	for _, arch := range archs {
+		if !slices.Contains([]Architecture{ArchAMD64, ArchARM64, ArchRiscV64, ArchCommon}, arch) {
+			return fmt.Errorf("unknown arch %s", arch)
+		}
+	}
+	for _, model := range models {
+		if !slices.Contains(SupportedModels, model) {
+			return fmt.Errorf("unknown model %s", model)
+		}
+	}
+	for _, constraint := range constraints {
+		if constraint == Common {
+			continue
+		}
+		if _, err := parseConstraint(constraint); err != nil {
+			return fmt.Errorf("invalid constraint %q: %w", constraint, err)
+		}
+	}
+	return nil
+}
+
+// mapValues returns the values of a map, sorted by key
+func mapValues[K ~string, V any](m map[K]V) []V {
+	result := make([]V, 0, len(m))
+	for _, k := range mapKeys(m) {
+		result = append(result, m[k])
+	}
+	return result
+}
+
+// mapKeys returns the sorted keys of a map
+func mapKeys[K ~string, V any](m map[K]V) []K {
+	result := make([]K, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
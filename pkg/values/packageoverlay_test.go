@@ -0,0 +1,149 @@
+package values
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+// restorePackageMaps puts back the package maps changed by the overlays once the test ends
+func restorePackageMaps(t *testing.T) {
+	clonePackageMap := func(m PackageMap) PackageMap {
+		c := PackageMap{}
+		for k, arches := range m {
+			c[k] = map[Architecture]VersionMap{}
+			for arch, versions := range arches {
+				c[k][arch] = VersionMap{}
+				for constraint, pkgs := range versions {
+					c[k][arch][constraint] = slices.Clone(pkgs)
+				}
+			}
+		}
+		return c
+	}
+	common := slices.Clone(CommonPackages)
+	base := clonePackageMap(BasePackages)
+	kernel := clonePackageMap(KernelPackages)
+	models := maps.Clone(KernelPackagesModels[Ubuntu][ArchARM64][Rpi4])
+	t.Cleanup(func() {
+		CommonPackages = common
+		BasePackages = base
+		KernelPackages = kernel
+		KernelPackagesModels[Ubuntu][ArchARM64][Rpi4] = models
+	})
+}
+
+func writeOverlay(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "overlay.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPackageOverlay(t *testing.T) {
+	restorePackageMaps(t)
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Model = Generic.String()
+
+	first := writeOverlay(t, `
+common:
+  remove: [nano]
+  add: [vim]
+base:
+  distro:
+    ubuntu:
+      amd64:
+        ">=24.04":
+          add: [new-package]
+  family:
+    debian:
+      common:
+        common:
+          remove: [fail2ban]
+          add: [fail2ban-custom]
+kernel:
+  distro:
+    ubuntu:
+      amd64:
+        "20.04 || 22.04 || 24.04 || 28.04":
+          replace: [linux-image-custom]
+kernel_models:
+  distro:
+    ubuntu:
+      arm64:
+        rpi4:
+          common:
+            replace: []
+`)
+	// Later overlays go on top of the previous ones
+	second := writeOverlay(t, "base:\n  distro:\n    ubuntu:\n      amd64:\n        \">=24.04\":\n          remove: [new-package]\n          add: [newer-package]\n")
+	if err := ApplyPackageOverlays([]string{first, second}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	l := logger.NewKairosLogger("test", "error", false)
+	sis := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Arch: ArchAMD64}
+	pkgs, err := GetPackages(sis, l)
+	if err != nil {
+		t.Fatalf("GetPackages: %v", err)
+	}
+	for _, p := range []string{"vim", "newer-package", "fail2ban-custom"} {
+		if !slices.Contains(pkgs, p) {
+			t.Errorf("expected %s in the packages, got %v", p, pkgs)
+		}
+	}
+	for _, p := range []string{"nano", "new-package", "fail2ban"} {
+		if slices.Contains(pkgs, p) {
+			t.Errorf("expected %s to be removed from the packages, got %v", p, pkgs)
+		}
+	}
+
+	kernel, err := GetKernelPackages(sis, l)
+	if err != nil {
+		t.Fatalf("GetKernelPackages: %v", err)
+	}
+	if !slices.Equal(kernel, []string{"linux-image-custom"}) {
+		t.Errorf("expected the kernel packages to be replaced, got %v", kernel)
+	}
+
+	config.DefaultConfig.Model = Rpi4.String()
+	kernel, err = GetKernelPackages(System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Arch: ArchARM64}, l)
+	if err != nil {
+		t.Fatalf("GetKernelPackages: %v", err)
+	}
+	if len(kernel) != 0 {
+		t.Errorf("expected no rpi4 kernel packages, got %v", kernel)
+	}
+}
+
+func TestPackageOverlayErrors(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		err     string
+	}{
+		"unknown map":        {"kernels: {}\n", "field kernels not found"},
+		"distro and family":  {"base:\n  ubuntu: {}\n", "field ubuntu not found"},
+		"unknown distro":     {"base:\n  distro:\n    ubuntoo:\n      amd64: {}\n", "unknown distro ubuntoo"},
+		"unknown family":     {"kernel_models:\n  family:\n    rhel:\n      arm64: {}\n", "unknown family rhel"},
+		"unknown arch":       {"base:\n  distro:\n    ubuntu:\n      x86_64: {}\n", "unknown arch x86_64"},
+		"unknown model":      {"kernel_models:\n  distro:\n    ubuntu:\n      arm64:\n        rpi5: {}\n", "unknown model rpi5"},
+		"invalid constraint": {"grub:\n  family:\n    redhat:\n      common:\n        \">=9 ||\":\n          add: [grub2]\n", "invalid constraint"},
+		"unknown operation":  {"grub:\n  family:\n    redhat:\n      common:\n        common:\n          rename: [grub2]\n", "field rename not found"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPackageOverlay(writeOverlay(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error with %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -1,9 +1,5 @@
 package values
 
-import (
-	"sort"
-)
-
 // Common Used for packages that are common to whatever key
 const Common = "common"
 
@@ -45,6 +41,10 @@ const (
 	Hadron             Distro = "hadron"
 )
 
+// KnownDistros are all the distros above but Unknown
+var KnownDistros = []Distro{Debian, Ubuntu, RedHat, RockyLinux, AlmaLinux, OracleLinux, Fedora, Arch, Alpine, OpenSUSELeap,
+	OpenSUSETumbleweed, SLES, SLEMicroRancher, Hadron}
+
 type Family string
 
 func (f Family) String() string {
@@ -62,13 +62,16 @@ const (
 	HadronFamily  Family = "hadron"
 )
 
+// KnownFamilies are all the families above but UnknownFamily
+var KnownFamilies = []Family{DebianFamily, RedHatFamily, ArchFamily, AlpineFamily, SUSEFamily, HadronFamily}
+
 type Model string              // Model is the type of the system
 func (m Model) String() string { return string(m) }
 
 const (
-	Generic Model = "generic"
-	Rpi3    Model = "rpi3"
-	Rpi4    Model = "rpi4"
+	Generic  Model = "generic"
+	Rpi3     Model = "rpi3"
+	Rpi4     Model = "rpi4"
 	AgxOrin  Model = "nvidia-jetson-agx-orin"
 	OrinNX   Model = "nvidia-jetson-orin-nx"
 	Thor     Model = "nvidia-jetson-thor"
@@ -103,11 +106,11 @@ func SupportedModelStrings() []string {
 }
 
 type System struct {
-	Name    string
-	Distro  Distro
-	Family  Family
-	Version string
-	Arch    Architecture
+	Name    string       `json:"name"`
+	Distro  Distro       `json:"distro"`
+	Family  Family       `json:"family"`
+	Version string       `json:"version"`
+	Arch    Architecture `json:"arch"`
 }
 
 // GetTemplateParams returns a map of parameters that can be used in a template
@@ -120,6 +123,7 @@ func GetTemplateParams(s System) map[string]string {
 	}
 }
 
+// StepInfo is the name and description of a stage or step, see stages.StepsInfo
 type StepInfo struct {
 	Key   string
 	Value string
@@ -136,7 +140,7 @@ const (
 	CleanupStep          = "cleanup"          // Cleans up the system of unneeded packages and files
 	ServicesStep         = "services"         // Creates and enables required services
 	KernelStep           = "kernel"           // Installs the kernel
-	KubernetesStep       = "kubernetes"       // Installs the kubernetes provider
+	KubernetesStep       = "kubernetes"       // Deprecated: never did anything, the provider is installed by providerBinaries
 	CloudconfigsStep     = "cloudconfigs"     // Installs the cloud-configs for the system
 	BrandingStep         = "branding"         // Applies the branding for the system
 	GrubStep             = "grub"             // Configures the grub bootloader
@@ -146,55 +150,9 @@ const (
 	InitramfsConfigsStep = "initramfsConfigs" // Configures the initramfs for the system
 	MiscellaneousStep    = "miscellaneous"    // Applies miscellaneous configurations
 	SshHardeningStep     = "sshHardening"     // Installs the sshd hardening drop-in and filters weak Diffie-Hellman moduli
+	SBOMStep             = "sbom"             // Writes the software bill of materials of the system
 )
 
-// StepsInfo returns a slice of StepInfo containing the steps and their descriptions
-func StepsInfo() []StepInfo {
-	steps := map[string]string{
-		InitStage:            "The full init stage, which includes kairosRelease, kubernetes, initrd, services, sshHardening, workarounds and cleanup steps",
-		InstallStage:         "The full install stage, which includes installPackages, kubernetes, cloudconfigs, branding, grub, services, kairosBinaries, providerBinaries, initramfsConfigs and miscellaneous steps",
-		InstallPackagesStep:  "installs the base system packages",
-		InstallKernelStep:    "installs the kernel packages",
-		InitrdStep:           "generates the initrd",
-		KairosReleaseStep:    "creates and fills the /etc/kairos-release file",
-		WorkaroundsStep:      "applies workarounds for known issues",
-		CleanupStep:          "cleans up the system of unneeded packages and files",
-		ServicesStep:         "creates and enables required services",
-		KernelStep:           "installs the kernel",
-		KubernetesStep:       "installs the kubernetes provider",
-		CloudconfigsStep:     "installs the cloud-configs for the system",
-		BrandingStep:         "applies the branding for the system",
-		GrubStep:             "configures the grub bootloader",
-		KairosBinariesStep:   "installs the kairos binaries",
-		ProviderBinariesStep: "installs the kairos provider binaries for k8s",
-		BuildProviderStep:    "builds the provider binaries",
-		InitramfsConfigsStep: "configures the initramfs for the system",
-		MiscellaneousStep:    "applies miscellaneous configurations",
-		SshHardeningStep:     "installs the sshd hardening drop-in",
-	}
-	keys := make([]string, 0, len(steps))
-	for k := range steps {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	ordered := make([]StepInfo, 0, len(keys))
-	for _, k := range keys {
-		ordered = append(ordered, StepInfo{Key: k, Value: steps[k]})
-	}
-	return ordered
-}
-
-// GetStepNames returns a slice of step names
-func GetStepNames() []string {
-	stepsInfo := StepsInfo()
-	steps := make([]string, 0, len(stepsInfo))
-	for step := range stepsInfo {
-		steps = append(steps, stepsInfo[step].Key)
-	}
-	return steps
-
-}
-
 // AllSuseRegex matches any SUSE-based distribution name.
 // AllSuseButMicroRegex matches SLES, openSUSE, or SUSE Linux Enterprise Server names.
 // AlpineRegex matches Alpine Linux distribution names.
@@ -0,0 +1,101 @@
+package values
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	semver "github.com/hashicorp/go-version"
+)
+
+// VersionScheme is how the version of a distro is read to check it against the constraints of the package maps
+type VersionScheme string
+
+const (
+	SemverScheme    VersionScheme = "semver"   // Releases with a version like 24.04 or 9.4
+	CalendarScheme  VersionScheme = "calendar" // Rolling releases with a snapshot date as version, like 20240101
+	NoVersionScheme VersionScheme = "none"     // Rolling releases without a version, only the common packages apply
+)
+
+// DistroVersionSchemes are the distros that don't use the SemverScheme
+var DistroVersionSchemes = map[Distro]VersionScheme{
+	Arch:               NoVersionScheme,
+	OpenSUSETumbleweed: CalendarScheme,
+}
+
+// unversionedReleases are distros that have releases without a version, like debian testing and sid
+// Those are rolling releases, so they use the NoVersionScheme
+var unversionedReleases = []Distro{Debian}
+
+// calendarVersion is a snapshot date, optionally followed by a build number
+var calendarVersion = regexp.MustCompile(`^\d{8}(\.\d+)?$`)
+
+// VersionScheme returns the version scheme of the system
+func (s System) VersionScheme() VersionScheme {
+	if scheme, ok := DistroVersionSchemes[s.Distro]; ok {
+		return scheme
+	}
+	if s.Version == "" && slices.Contains(unversionedReleases, s.Distro) {
+		return NoVersionScheme
+	}
+	return SemverScheme
+}
+
+// ParseVersion returns the version of the system to check the constraints against, nil for the NoVersionScheme
+func (s System) ParseVersion() (*semver.Version, error) {
+	switch s.VersionScheme() {
+	case NoVersionScheme:
+		return nil, nil
+	case CalendarScheme:
+		if !calendarVersion.MatchString(s.Version) {
+			return nil, fmt.Errorf("invalid version %q for %s, expected a snapshot date like 20240101", s.Version, s.Distro)
+		}
+	}
+	v, err := semver.NewVersion(s.Version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version %q for %s: %w", s.Version, s.Distro, err)
+	}
+	return v, nil
+}
+
+// packageConstraint is a parsed constraint of the package maps
+// It can be limited to a version scheme with a prefix, like "calendar: >=20240101" or "semver: >=15.5", otherwise it
+// applies to any system with a version. If the constraint has "||" it means we have multiple constraints, which are
+// checked independently like an OR operation, as the underlying lib does not handle OR easily so we do it ourselves
+type packageConstraint struct {
+	scheme      VersionScheme
+	constraints []semver.Constraints
+}
+
+func parseConstraint(constraint string) (packageConstraint, error) {
+	var pc packageConstraint
+	if scheme, rest, found := strings.Cut(constraint, ":"); found {
+		pc.scheme = VersionScheme(strings.TrimSpace(scheme))
+		if pc.scheme != SemverScheme && pc.scheme != CalendarScheme {
+			return pc, fmt.Errorf("unknown version scheme %s in constraint %q", pc.scheme, constraint)
+		}
+		constraint = rest
+	}
+	for _, c := range strings.Split(constraint, "||") {
+		parsed, err := semver.NewConstraint(strings.TrimSpace(c))
+		if err != nil {
+			return pc, err
+		}
+		pc.constraints = append(pc.constraints, parsed)
+	}
+	return pc, nil
+}
+
+// check returns true if the version of a system with the given scheme matches the constraint
+func (pc packageConstraint) check(scheme VersionScheme, v *semver.Version) bool {
+	if v == nil || (pc.scheme != "" && pc.scheme != scheme) {
+		return false
+	}
+	for _, c := range pc.constraints {
+		if c.Check(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package values
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types/logger"
+)
+
+func TestVersionScheme(t *testing.T) {
+	tests := []struct {
+		name   string
+		system System
+		scheme VersionScheme
+		err    string
+	}{
+		{name: "release", system: System{Distro: Ubuntu, Version: "24.04"}, scheme: SemverScheme},
+		{name: "release without version", system: System{Distro: Ubuntu}, scheme: SemverScheme, err: "invalid version"},
+		{name: "snapshot", system: System{Distro: OpenSUSETumbleweed, Version: "20240101"}, scheme: CalendarScheme},
+		{name: "invalid snapshot", system: System{Distro: OpenSUSETumbleweed, Version: "15.5"}, scheme: CalendarScheme, err: "snapshot date"},
+		{name: "rolling", system: System{Distro: Arch}, scheme: NoVersionScheme},
+		{name: "debian sid", system: System{Distro: Debian}, scheme: NoVersionScheme},
+		{name: "debian release", system: System{Distro: Debian, Version: "12"}, scheme: SemverScheme},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.system.VersionScheme(); got != tt.scheme {
+				t.Errorf("expected scheme %s, got %s", tt.scheme, got)
+			}
+			_, err := tt.system.ParseVersion()
+			if tt.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected an error with %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRollingReleasePackages(t *testing.T) {
+	restorePackageMaps(t)
+	prev := config.DefaultConfig
+	t.Cleanup(func() { config.DefaultConfig = prev })
+	config.DefaultConfig.Model = Generic.String()
+	l := logger.NewKairosLogger("test", "error", false)
+
+	BasePackages[OpenSUSETumbleweed] = map[Architecture]VersionMap{
+		ArchCommon: {
+			"calendar: >=20240101": {"new-snapshot"},
+			"calendar: <20240101":  {"old-snapshot"},
+			"semver: >=15.5":       {"leap-only"},
+			">=15.5":               {"any-version"},
+		},
+	}
+	pkgs, err := GetPackages(System{Distro: OpenSUSETumbleweed, Family: SUSEFamily, Version: "20240315", Arch: ArchAMD64}, l)
+	if err != nil {
+		t.Fatalf("GetPackages: %v", err)
+	}
+	for _, p := range []string{"new-snapshot", "any-version", "systemd-networkd"} {
+		if !strings.Contains(strings.Join(pkgs, " "), p) {
+			t.Errorf("expected %s in the packages, got %v", p, pkgs)
+		}
+	}
+	for _, p := range []string{"old-snapshot", "leap-only"} {
+		for _, got := range pkgs {
+			if got == p {
+				t.Errorf("expected no %s in the packages, got %v", p, pkgs)
+			}
+		}
+	}
+
+	// Without a version only the common packages apply, but they always do
+	config.DefaultConfig.Model = Rpi4.String()
+	pkgs, err = GetKernelPackages(System{Distro: Arch, Family: ArchFamily, Arch: ArchARM64}, l)
+	if err != nil {
+		t.Fatalf("GetKernelPackages: %v", err)
+	}
+	if len(pkgs) != 1 || pkgs[0] != "linux-rpi" {
+		t.Errorf("expected the common kernel packages, got %v", pkgs)
+	}
+	config.DefaultConfig.Model = Generic.String()
+
+	if _, err = GetPackages(System{Distro: Ubuntu, Family: DebianFamily, Version: "noble", Arch: ArchAMD64}, l); err == nil {
+		t.Errorf("expected an error for a version that can't be parsed")
+	}
+	if _, err = GetKernelPackages(System{Distro: Ubuntu, Family: DebianFamily, Version: "noble", Arch: ArchAMD64}, l); err == nil {
+		t.Errorf("expected an error for a version that can't be parsed")
+	}
+}